@@ -0,0 +1,164 @@
+package cc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"dbt-rules/RULES/core"
+)
+
+// MemoryBudget limits the size of a memory region or an output section of a
+// binary.
+type MemoryBudget struct {
+	// Name of a memory region of the linker script (e.g. "FLASH"), or of an
+	// output section (e.g. ".text").
+	Name string
+
+	// Maximum size in bytes.
+	Size uint64
+}
+
+type MemoryBudgetScriptParams struct {
+	Elf     core.Path
+	Map     core.Path
+	Script  core.Path
+	Out     core.OutPath
+	Budgets string
+}
+
+// The script reads the sections from the ELF section headers, and their load
+// addresses from the program headers. Like ld's --print-memory-usage, a
+// section counts towards the region containing its address, and also towards
+// the region containing its load address if that differs (e.g. .data, which is
+// loaded from flash). Regions are read from the map file of GNU ld, or from the
+// MEMORY command of the linker script, as lld doesn't list them in its map.
+var memoryBudgetScript = `#!/usr/bin/env python3
+import json
+import re
+import struct
+import sys
+
+SHF_ALLOC = 0x2
+SHT_NOBITS = 8
+
+budgets = json.loads(r'''{{ .Budgets }}''') or []
+
+` + elfReaderPython + `
+
+def read_sections(path):
+    _, _, segments, headers = read_elf(path)
+    sections = {}
+    for header in headers:
+        addr, size = header["Addr"], header["Size"]
+        if not header["Flags"] & SHF_ALLOC or size == 0:
+            continue
+        lma = addr
+        for vaddr, paddr, memsz in segments:
+            if vaddr <= addr < vaddr + memsz:
+                lma = addr - vaddr + paddr
+                break
+        sections[header["Name"]] = {"Size": size, "Vma": addr, "Lma": lma, "Loaded": header["Type"] != SHT_NOBITS}
+    return sections
+
+
+def read_regions(path):
+    regions = {}
+    in_table = False
+    with open(path) as f:
+        for line in f:
+            if line.startswith("Memory Configuration"):
+                in_table = True
+            elif line.startswith("Linker script and memory map"):
+                break
+            elif in_table:
+                fields = line.split()
+                if len(fields) >= 3 and fields[1].startswith("0x") and fields[0] != "*default*":
+                    regions[fields[0]] = {"Origin": int(fields[1], 16), "Length": int(fields[2], 16), "Used": 0}
+    return regions if in_table else None
+
+
+def eval_size(expr):
+    expr = re.sub(r"(0[xX][0-9a-fA-F]+|\d+)\s*([KkMm])", lambda m: "(%s*%d)" % (m.group(1), 1024 if m.group(2) in "Kk" else 1024 * 1024), expr)
+    if not re.fullmatch(r"[0-9a-fA-FxX+\-*/() \t]*", expr):
+        sys.exit("Cannot evaluate %r in the MEMORY command of {{ .Script }}" % expr)
+    return int(eval(expr.replace("/", "//")))
+
+
+def read_script_regions(path):
+    with open(path) as f:
+        script = re.sub(r"/\*.*?\*/", "", f.read(), flags=re.S)
+    regions = {}
+    memory = re.search(r"\bMEMORY\s*{(.*?)}", script, re.S)
+    if memory:
+        for m in re.finditer(r"(\w+)\s*(?:\([^)]*\))?\s*:\s*(?:ORIGIN|org|o)\s*=\s*([^,]+),\s*(?:LENGTH|len|l)\s*=\s*([^\n]+)", memory.group(1)):
+            regions[m.group(1)] = {"Origin": eval_size(m.group(2)), "Length": eval_size(m.group(3)), "Used": 0}
+    return regions
+
+
+sections = read_sections("{{ .Elf }}")
+regions = read_regions("{{ .Map }}")
+if regions is None:
+    regions = {{ if .Script }}read_script_regions("{{ .Script }}"){{ else }}{}{{ end }}
+
+for section in sections.values():
+    addrs = {section["Vma"]}
+    if section["Loaded"]:
+        addrs.add(section["Lma"])
+    for region in regions.values():
+        if any(region["Origin"] <= a < region["Origin"] + region["Length"] for a in addrs):
+            region["Used"] += section["Size"]
+
+results = []
+for budget in budgets:
+    name = budget["Name"]
+    if name in regions:
+        used = regions[name]["Used"]
+    elif name in sections:
+        used = sections[name]["Size"]
+    else:
+        sys.exit("Memory budget for unknown region or section %s of {{ .Elf }}" % name)
+    results.append({"Name": name, "Budget": budget["Size"], "Used": used, "Exceeded": used > budget["Size"]})
+
+with open("{{ .Out }}", "w") as f:
+    json.dump({"Sections": sections, "Regions": regions, "Budgets": results}, f, indent=2, sort_keys=True)
+
+if any(r["Exceeded"] for r in results):
+    print("Memory budget exceeded for {{ .Elf }}:")
+    print("  %-24s %12s %12s %8s" % ("REGION/SECTION", "USED", "BUDGET", "USE"))
+    for r in results:
+        print("  %-24s %12d %12d %7.1f%%%s" % (r["Name"], r["Used"], r["Budget"],
+              100.0 * r["Used"] / max(r["Budget"], 1), "  <-- exceeded" if r["Exceeded"] else ""))
+    sys.exit(1)
+`
+
+// SizeReport returns the path of the JSON report of section and region sizes,
+// written along with the map file.
+func (bin Binary) SizeReport() core.OutPath {
+	return bin.Out.WithSuffix(".size.json")
+}
+
+// checkMemoryBudgets adds a post-link step that writes the size report and
+// fails if any budget is exceeded.
+func (bin Binary) checkMemoryBudgets(ctx core.Context, script core.Path) {
+	budgets, err := json.Marshal(bin.Budgets)
+	if err != nil {
+		core.Fatal("failed to marshal memory budgets: %s", err)
+	}
+	data := MemoryBudgetScriptParams{
+		Elf:     bin.Out,
+		Map:     bin.MapFile(),
+		Script:  script,
+		Out:     bin.SizeReport(),
+		Budgets: string(budgets),
+	}
+	ins := []core.Path{bin.Out, bin.MapFile()}
+	if script != nil {
+		ins = append(ins, script)
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:    bin.SizeReport(),
+		Ins:    ins,
+		Script: core.CompileTemplate(memoryBudgetScript, "memory-budget-script", data),
+		Descr:  fmt.Sprintf("BUDGET %s", bin.Out.Relative()),
+	})
+}
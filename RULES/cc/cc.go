@@ -7,32 +7,78 @@ import (
 	"dbt-rules/RULES/core"
 )
 
-// ObjectFile compiles a single C++ source file.
+// ObjectFile compiles a single C, C++ or assembly source file.
 type ObjectFile struct {
 	Src       core.Path
 	Includes  []core.Path
 	Flags     []string
+	OrderOnly []core.Path
 	Toolchain Toolchain
+
+	// Compile position-independent code, for shared libraries.
+	PIC bool
+
+	// Precompiled header to force-include, built by a PrecompiledHeader step.
+	PrecompiledHeader core.Path
+}
+
+// command returns the compile command.
+func (obj ObjectFile) command() string {
+	toolchain := toolchainOrDefault(obj.Toolchain)
+	flags := obj.Flags
+	if obj.PIC {
+		flags = append([]string{"-fPIC"}, flags...)
+	}
+	if obj.PrecompiledHeader != nil {
+		flags = append(usePrecompiledHeaderFlags(toolchain, obj.PrecompiledHeader), flags...)
+	}
+	return toolchain.ObjectFile(obj.out(), obj.depfile(), flags, obj.Includes, obj.Src)
+}
+
+// depfile returns the path of the depfile, or nil for raw assembly, which has
+// no includes for the compiler to list.
+func (obj ObjectFile) depfile() core.OutPath {
+	if SourceLanguage(obj.Src) == LanguageAssembly {
+		return nil
+	}
+	return obj.out().WithExt("d")
 }
 
 // Build an ObjectFile.
 func (obj ObjectFile) Build(ctx core.Context) {
 	toolchain := toolchainOrDefault(obj.Toolchain)
-	depfile := obj.out().WithExt("d")
-	cmd := toolchain.ObjectFile(obj.out(), depfile, obj.Flags, obj.Includes, obj.Src)
+	cmd := obj.command()
+	// Targets may share an object, but only if they compile it the same way.
+	if ctx.Built(obj.out().Absolute() + "\n" + cmd) {
+		return
+	}
+	if ctx.Built(obj.out().Absolute()) {
+		core.Fatal("%s is compiled to %s by several targets with different flags. Move it to a library, or compile it with a different toolchain. Dependency path:\n  %s",
+			obj.Src.Relative(), obj.out().Relative(), strings.Join(ctx.Trace(), "\n  -> "))
+		return
+	}
+	ins := []core.Path{}
+	if obj.PrecompiledHeader != nil {
+		ins = append(ins, obj.PrecompiledHeader)
+	}
 	ctx.WithTrace("obj:"+obj.out().Relative(), func(ctx core.Context) {
 		ctx.AddBuildStep(core.BuildStep{
-			Out:     obj.out(),
-			Depfile: depfile,
-			In:      obj.Src,
-			Cmd:     cmd,
-			Descr:   fmt.Sprintf("CC (toolchain: %s) %s", toolchain.Name(), obj.out().Relative()),
+			Out:       obj.out(),
+			Depfile:   obj.depfile(),
+			In:        obj.Src,
+			Ins:       ins,
+			OrderOnly: obj.OrderOnly,
+			Cmd:       cmd,
+			Descr:     fmt.Sprintf("CC (toolchain: %s) %s", toolchain.Name(), obj.out().Relative()),
 		})
 	})
 }
 
 func (obj ObjectFile) out() core.OutPath {
 	toolchain := toolchainOrDefault(obj.Toolchain)
+	if obj.PIC {
+		return obj.Src.WithPrefix(toolchain.Name() + "/").WithExt("pic.o")
+	}
 	return obj.Src.WithPrefix(toolchain.Name() + "/").WithExt("o")
 }
 
@@ -60,64 +106,150 @@ func (blob BlobObject) out() core.OutPath {
 	return blob.In.WithPrefix(toolchain.Name() + "/").WithExt("blob.o")
 }
 
-func collectDepsWithToolchainRec(toolchain Toolchain, deps []Dep, visited map[string]bool) []Library {
-	var flatDeps []Library
-	for _, dep := range deps {
-		lib := dep.CcLibrary(toolchain)
+// compileOptions are the rule-specific settings for compiling sources.
+type compileOptions struct {
+	Flags           compilerFlags
+	PrivateIncludes []core.Path
+	PIC             bool
 
-		libPath := lib.Out.Absolute()
-		if !visited[libPath] {
-			visited[libPath] = true
-			flatDeps = append(flatDeps, lib)
-			flatDeps = append(flatDeps, collectDepsWithToolchainRec(toolchain, lib.Deps, visited)...)
-		}
-	}
-	return flatDeps
-}
+	// Header to precompile and force-include in all C++ sources, and the base
+	// path to generate the precompiled header at. The path is made specific to
+	// the toolchain and flags.
+	PrecompiledHeader    core.Path
+	PrecompiledHeaderOut core.OutPath
 
-func collectDepsWithToolchain(toolchain Toolchain, deps []Dep) []Library {
-	return collectDepsWithToolchainRec(toolchain, deps, map[string]bool{})
+	// Report collecting the lint findings of all sources, if linting is enabled.
+	LintReport core.OutPath
 }
 
-func compileSources(ctx core.Context, srcs []core.Path, flags []string, deps []Library, toolchain Toolchain) []core.Path {
-	includes := []core.Path{core.SourcePath("")}
+// compileSources compiles the sources with the usage requirements (includes,
+// defines and public compiler flags) of all deps, in addition to the private
+// includes and flags.
+func compileSources(ctx core.Context, srcs []core.Path, opts compileOptions, deps []Library, toolchain Toolchain) []core.Path {
+	includes := append([]core.Path{core.SourcePath("")}, opts.PrivateIncludes...)
+	hdrs := []core.Path{}
+	flags := opts.Flags
+	flags.Common = append([]string{}, flags.Common...)
 	for _, dep := range deps {
 		includes = append(includes, dep.Includes...)
+		hdrs = append(hdrs, dep.Hdrs...)
+		flags.Common = append(flags.Common, definesToFlags(dep.Defines)...)
+		flags.Common = append(flags.Common, dep.PublicCompilerFlags...)
+	}
+
+	var pchWrapper, pch core.Path
+	if opts.PrecompiledHeader != nil {
+		pchWrapper, pch = buildPrecompiledHeader(ctx, opts, flags, includes, hdrs, toolchain)
 	}
 
 	objs := []core.Path{}
+	lintLogs := []core.Path{}
 
 	for _, src := range srcs {
 		obj := ObjectFile{
 			Src:       src,
 			Includes:  includes,
-			Flags:     flags,
+			Flags:     flags.forSource(src),
+			OrderOnly: hdrs,
 			Toolchain: toolchain,
+			PIC:       opts.PIC,
+		}
+		if SourceLanguage(src) == LanguageCxx {
+			obj.PrecompiledHeader = pch
 		}
 		obj.Build(ctx)
 		objs = append(objs, obj.out())
+
+		language := SourceLanguage(src)
+		if lintEnabled() && opts.LintReport != nil && language != LanguageAssembly && language != LanguageAssemblyWithCpp {
+			lintLogs = append(lintLogs, obj.lint(ctx, pchWrapper))
+		}
+	}
+
+	if len(lintLogs) > 0 {
+		lintReport(ctx, opts.LintReport, lintLogs)
 	}
 
 	return objs
 }
 
+func definesToFlags(defines []string) []string {
+	flags := []string{}
+	for _, define := range defines {
+		flags = append(flags, fmt.Sprintf("-D%q", define))
+	}
+	return flags
+}
+
 // Dep is an interface implemented by dependencies that can be linked into a library.
 type Dep interface {
 	CcLibrary(toolchain Toolchain) Library
 }
 
+// Generator is implemented by targets that generate sources or headers of a
+// Library. Generators must tolerate being built more than once.
+type Generator interface {
+	Build(ctx core.Context)
+}
+
 // Library builds and links a static C++ library.
+//
+// Includes, Defines and PublicCompilerFlags are usage requirements: they apply
+// to the library's own sources and to the sources of everything depending on
+// it, directly or transitively. PublicLinkerFlags apply to the binaries
+// depending on it. PrivateIncludes, PrivateDefines and
+// CompilerFlags (and their per-language variants) only apply to the library's
+// own sources. A library without Srcs, Objs and Blobs is header-only: no
+// archive is built or linked for it.
 type Library struct {
-	Out           core.OutPath
-	Srcs          []core.Path
-	Blobs         []core.Path
-	Objs          []core.Path
-	Includes      []core.Path
-	CompilerFlags []string
-	Deps          []Dep
-	Shared        bool
-	AlwaysLink    bool
-	Toolchain     Toolchain
+	Out                 core.OutPath
+	Srcs                []core.Path
+	Blobs               []core.Path
+	Objs                []core.Path
+	Includes            []core.Path
+	PrivateIncludes     []core.Path
+	Defines             []string
+	PrivateDefines      []string
+	PublicCompilerFlags []string
+	PublicLinkerFlags   []string
+	CompilerFlags       []string
+	CFlags              []string
+	CxxFlags            []string
+	AsFlags             []string
+	Deps                []Dep
+	Shared              bool
+	AlwaysLink          bool
+	Toolchain           Toolchain
+
+	// Version of a shared library, e.g. "1.2.3". If set, the library is
+	// linked as Out.1.2.3, with symlinks Out.1 (the soname) and Out.
+	Version string
+
+	// Soname of a shared library, if different from the default (the base name
+	// of Out, followed by the major version if Version is set).
+	Soname string
+
+	// Compile the library without link-time optimisation even if the
+	// toolchain enables it, e.g. for hand-written startup code.
+	DisableLTO bool
+
+	// Header that is precompiled once and force-included in every C++ source
+	// of the library. Toolchains that don't support precompiled headers just
+	// force-include it.
+	PrecompiledHeader core.Path
+
+	// Headers that must exist before any source of this library, or of a library
+	// or binary depending on it, is compiled. Only needed for generated headers.
+	Hdrs []core.Path
+
+	// Targets generating Srcs or Hdrs. If Out is among the Outputs() of a
+	// generator, the library is used as generated instead of being built, see
+	// PrebuiltLibrary and ExternalProject.
+	Generators []Generator
+
+	// The library is part of an intentional dependency cycle. All libraries
+	// of the cycle must set it, and are linked in a group.
+	AllowCyclicDeps bool
 }
 
 // multipleToolchainLibrary is a library that can be built
@@ -155,6 +287,19 @@ func (mtl multipleToolchainLibrary) Build(ctx core.Context) {
 	mtl.CcLibrary(DefaultToolchain()).Build(ctx)
 }
 
+func (lib Library) compilerFlags() compilerFlags {
+	common := definesToFlags(lib.PrivateDefines)
+	if lib.DisableLTO {
+		common = append(common, "-fno-lto")
+	}
+	return compilerFlags{
+		Common: append(common, lib.CompilerFlags...),
+		C:      lib.CFlags,
+		Cxx:    lib.CxxFlags,
+		As:     lib.AsFlags,
+	}
+}
+
 // Build a Library.
 func (lib Library) build(ctx core.Context) {
 	if lib.Out == nil {
@@ -165,14 +310,39 @@ func (lib Library) build(ctx core.Context) {
 		return
 	}
 
+	if lib.generatedOut() {
+		for _, gen := range lib.Generators {
+			gen.Build(ctx)
+		}
+		return
+	}
+
 	toolchain := toolchainOrDefault(lib.Toolchain)
 
-	deps := collectDepsWithToolchain(toolchain, append(toolchain.StdDeps(), lib))
+	for _, gen := range lib.Generators {
+		gen.Build(ctx)
+	}
+
+	deps, _ := collectDepsWithToolchain(ctx, toolchain, append(toolchain.StdDeps(), lib))
 	for _, d := range deps {
 		d.Build(ctx)
 	}
+	if lib.headerOnly() {
+		return
+	}
 
-	objs := compileSources(ctx, lib.Srcs, lib.CompilerFlags, deps, toolchain)
+	opts := compileOptions{
+		Flags:             lib.compilerFlags(),
+		PrivateIncludes:   lib.PrivateIncludes,
+		PIC:               lib.Shared,
+		PrecompiledHeader: lib.PrecompiledHeader,
+		LintReport:        lib.Out.WithSuffix(".lint"),
+	}
+	if lib.PrecompiledHeader != nil {
+		opts.PrecompiledHeaderOut = lib.Out.WithExt("pch")
+	}
+	objs := compileSources(ctx, lib.Srcs, opts, deps, toolchain)
+	checkLayering(ctx, lib.Out, lib.Srcs, objs, lib.headerOwner(), lib.Deps, toolchain)
 	objs = append(objs, lib.Objs...)
 
 	for _, blob := range lib.Blobs {
@@ -181,23 +351,39 @@ func (lib Library) build(ctx core.Context) {
 		objs = append(objs, blobObject.out())
 	}
 
-	var cmd, descr string
 	if lib.Shared {
-		cmd = toolchain.SharedLibrary(lib.Out, objs)
-		descr = fmt.Sprintf("LD (toolchain: %s) %s", toolchain.Name(), lib.Out.Relative())
-	} else {
-		cmd = toolchain.StaticLibrary(lib.Out, objs)
-		descr = fmt.Sprintf("AR (toolchain: %s) %s", toolchain.Name(), lib.Out.Relative())
+		lib.buildShared(ctx, toolchain, objs)
+		return
 	}
 
 	ctx.AddBuildStep(core.BuildStep{
 		Out:   lib.Out,
 		Ins:   objs,
-		Cmd:   cmd,
-		Descr: descr,
+		Cmd:   toolchain.StaticLibrary(lib.Out, objs),
+		Descr: fmt.Sprintf("AR (toolchain: %s) %s", toolchain.Name(), lib.Out.Relative()),
 	})
 }
 
+// generatedOut reports whether Out is generated by one of the Generators.
+func (lib Library) generatedOut() bool {
+	for _, gen := range lib.Generators {
+		if outputs, ok := gen.(interface{ Outputs() []core.Path }); ok {
+			for _, out := range outputs.Outputs() {
+				if out.Absolute() == lib.Out.Absolute() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// headerOnly reports whether the library has nothing to archive, e.g. when it
+// only has headers or usage requirements. No archive is built or linked then.
+func (lib Library) headerOnly() bool {
+	return len(lib.Srcs) == 0 && len(lib.Objs) == 0 && len(lib.Blobs) == 0 && !lib.generatedOut()
+}
+
 func (lib Library) Build(ctx core.Context) {
 	ctx.WithTrace("lib:"+lib.Out.Relative(), lib.build)
 }
@@ -206,8 +392,8 @@ func (lib Library) Build(ctx core.Context) {
 func (lib Library) CcLibrary(toolchain Toolchain) Library {
 	toolchain = toolchainOrDefault(toolchain)
 
-	if !ToolchainAccepts(toolchain, toolchainOrDefault(lib.Toolchain)) {
-		core.Fatal("Library %s does not support toolchain %s", lib.Out.Relative(), toolchain.Name())
+	if mismatch := toolchainMismatch(toolchain, toolchainOrDefault(lib.Toolchain)); mismatch != "" {
+		core.Fatal("Library %s does not support toolchain %s: %s", lib.Out.Relative(), toolchain.Name(), mismatch)
 	}
 	return lib
 }
@@ -217,10 +403,35 @@ type Binary struct {
 	Out           core.OutPath
 	Srcs          []core.Path
 	CompilerFlags []string
+	CFlags        []string
+	CxxFlags      []string
+	AsFlags       []string
 	LinkerFlags   []string
 	Deps          []Dep
 	Script        core.Path
 	Toolchain     Toolchain
+
+	// Also write a linker map file, at MapFile(), and a JSON report of the
+	// sizes of sections and memory regions, at SizeReport().
+	Map bool
+
+	// Limits on the sizes of memory regions or sections, checked after linking.
+	// Implies Map.
+	Budgets []MemoryBudget
+
+	// Strip the executable, and write its debug info to DebugFile(), which the
+	// executable refers to with a GNU debuglink. A build-id is embedded in both.
+	SplitDebugInfo bool
+}
+
+// MapFile returns the path of the linker map file, if Map is set.
+func (bin Binary) MapFile() core.OutPath {
+	return bin.Out.WithSuffix(".map")
+}
+
+// writesMap reports whether the linker writes a map file.
+func (bin Binary) writesMap() bool {
+	return bin.Map || len(bin.Budgets) > 0
 }
 
 // Build a Binary.
@@ -232,39 +443,74 @@ func (bin Binary) Build(ctx core.Context) {
 }
 
 func (bin Binary) build(ctx core.Context) {
+	if ctx.Built(bin.Out.Absolute()) {
+		return
+	}
+
 	toolchain := toolchainOrDefault(bin.Toolchain)
 
-	deps := collectDepsWithToolchain(toolchain, append(bin.Deps, toolchain.StdDeps()...))
+	deps, linkGroups := collectDepsWithToolchain(ctx, toolchain, append(bin.Deps, toolchain.StdDeps()...))
 	for _, d := range deps {
 		d.Build(ctx)
 	}
-	objs := compileSources(ctx, bin.Srcs, bin.CompilerFlags, deps, toolchain)
+	flags := compilerFlags{Common: bin.CompilerFlags, C: bin.CFlags, Cxx: bin.CxxFlags, As: bin.AsFlags}
+	opts := compileOptions{Flags: flags, LintReport: bin.Out.WithSuffix(".lint")}
+	objs := compileSources(ctx, bin.Srcs, opts, deps, toolchain)
+	checkLayering(ctx, bin.Out, bin.Srcs, objs, newHeaderOwner(bin.Srcs, nil, nil), bin.Deps, toolchain)
 
 	ins := objs
 	alwaysLinkLibs := []core.Path{}
-	otherLibs := []core.Path{}
+	otherLibs := []Library{}
 	for _, dep := range deps {
+		if dep.headerOnly() {
+			continue
+		}
 		ins = append(ins, dep.Out)
 		if dep.AlwaysLink {
 			alwaysLinkLibs = append(alwaysLinkLibs, dep.Out)
 		} else {
-			otherLibs = append(otherLibs, dep.Out)
+			otherLibs = append(otherLibs, dep)
 		}
 	}
+	libs, linkerFlags := linkLine(otherLibs, linkGroups)
 
-	if bin.Script != nil {
-		ins = append(ins, bin.Script)
-	} else if toolchain.Script() != nil {
-		ins = append(ins, toolchain.Script())
+	script := bin.Script
+	if script == nil {
+		script = toolchain.Script()
+	}
+	if script != nil {
+		ins = append(ins, script)
 	}
 
-	cmd := toolchain.Binary(bin.Out, objs, alwaysLinkLibs, otherLibs, bin.LinkerFlags, bin.Script)
+	linkerFlags = append(append(linkerFlags, rpathFlags(bin.Out, deps)...), bin.LinkerFlags...)
+	for _, dep := range deps {
+		linkerFlags = append(linkerFlags, dep.PublicLinkerFlags...)
+	}
+	outs := []core.OutPath{}
+	if bin.writesMap() {
+		linkerFlags = append(linkerFlags, fmt.Sprintf("-Wl,-Map=%q", bin.MapFile()))
+		outs = append(outs, bin.MapFile())
+	}
+	linked := bin.Out
+	if bin.SplitDebugInfo {
+		linked = bin.unstripped()
+		linkerFlags = append(linkerFlags, "-Wl,--build-id")
+	}
+	cmd := toolchain.Binary(linked, objs, alwaysLinkLibs, libs, linkerFlags, bin.Script)
 	ctx.AddBuildStep(core.BuildStep{
-		Out:   bin.Out,
+		Out:   linked,
+		Outs:  outs,
 		Ins:   ins,
 		Cmd:   cmd,
-		Descr: fmt.Sprintf("LD (toolchain: %s) %s", toolchain.Name(), bin.Out.Relative()),
+		Descr: fmt.Sprintf("LD (toolchain: %s) %s", toolchain.Name(), linked.Relative()),
 	})
+
+	if bin.SplitDebugInfo {
+		bin.splitDebugInfo(ctx, toolchain)
+	}
+	if bin.writesMap() {
+		bin.checkMemoryBudgets(ctx, script)
+	}
 }
 
 func (bin Binary) Run(args []string) string {
@@ -274,3 +520,42 @@ func (bin Binary) Run(args []string) string {
 	}
 	return fmt.Sprintf("%q %s", bin.Out, strings.Join(quotedArgs, " "))
 }
+
+// HostBinary is a Binary that is always built with the host toolchain, in its
+// own output subtree. Build steps can use it as a tool (e.g., a code generator)
+// regardless of the toolchain selected for the targets consuming its output.
+// Libraries it depends on must support the host toolchain, e.g. by using
+// Library.MultipleToolchains().
+type HostBinary struct {
+	bin Binary
+}
+
+// Host returns the host-toolchain variant of the binary.
+func (bin Binary) Host() HostBinary {
+	if bin.Out == nil {
+		core.Fatal("Out field is required for cc.Binary")
+	}
+	return HostBinary{bin: bin}
+}
+
+// Out returns the path of the host executable.
+func (host HostBinary) Out() core.OutPath {
+	return host.bin.Out.WithPrefix("host/")
+}
+
+func (host HostBinary) binary() Binary {
+	bin := host.bin
+	bin.Out = host.Out()
+	bin.Toolchain = HostToolchain()
+	return bin
+}
+
+// Build the host executable. Like any Binary, it is built at most once, so
+// every target that uses it as a tool can build it.
+func (host HostBinary) Build(ctx core.Context) {
+	host.binary().Build(ctx)
+}
+
+func (host HostBinary) Run(args []string) string {
+	return host.binary().Run(args)
+}
@@ -0,0 +1,184 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// ClangToolchain represents a Clang/LLVM toolchain. A single LLVM installation
+// can target any supported architecture by setting Target.
+type ClangToolchain struct {
+	Cc      core.GlobalPath // clang
+	Cxx     core.GlobalPath // clang++
+	Ar      core.GlobalPath // llvm-ar
+	Objcopy core.GlobalPath // llvm-objcopy
+	Ld      core.GlobalPath // ld.lld
+	Size    core.GlobalPath // llvm-size
+
+	// Target triple passed with --target=, e.g. "aarch64-none-elf".
+	// If empty, clang compiles for the host.
+	Target string
+
+	// Passed with --sysroot= if not empty.
+	Sysroot string
+
+	Includes     []core.Path
+	Deps         []Dep
+	LinkerScript core.Path
+
+	CompilerFlags []string
+	CFlags        []string
+	CxxFlags      []string
+	AsFlags       []string
+	LinkerFlags   []string
+
+	ToolchainName string
+
+	// See GccToolchain.CompatibleWith.
+	CompatibleWith []string
+
+	// See GccToolchain.CxxStdlib.
+	CxxStdlib string
+
+	// Enables link-time optimisation. llvm-ar indexes LTO objects itself.
+	LTO bool
+}
+
+// gcc returns the equivalent GccToolchain. Clang accepts the same command
+// lines as gcc, so the commands are generated by it.
+func (clang ClangToolchain) gcc() GccToolchain {
+	targetFlags := []string{}
+	if clang.Target != "" {
+		targetFlags = append(targetFlags, fmt.Sprintf("--target=%s", clang.Target))
+	}
+	if clang.Sysroot != "" {
+		targetFlags = append(targetFlags, fmt.Sprintf("--sysroot=%q", clang.Sysroot))
+	}
+
+	return GccToolchain{
+		Ar:      clang.Ar,
+		Cc:      clang.Cc,
+		Cxx:     clang.Cxx,
+		Objcopy: clang.Objcopy,
+		Ld:      clang.Ld,
+		Size:    clang.Size,
+
+		Includes:     clang.Includes,
+		Deps:         clang.Deps,
+		LinkerScript: clang.LinkerScript,
+
+		CompilerFlags: append(append([]string{}, targetFlags...), clang.CompilerFlags...),
+		CFlags:        clang.CFlags,
+		CxxFlags:      clang.CxxFlags,
+		AsFlags:       clang.AsFlags,
+		LinkerFlags:   append(append(append([]string{}, targetFlags...), "-fuse-ld=lld"), clang.LinkerFlags...),
+
+		ToolchainName:  clang.ToolchainName,
+		ArchName:       clang.archName(),
+		TargetName:     clang.Target,
+		CompatibleWith: clang.CompatibleWith,
+		CxxStdlib:      clang.CxxStdlib,
+		LTO:            clang.LTO,
+		LtoAr:          clang.Ar,
+	}
+}
+
+func (clang ClangToolchain) sysroot() string {
+	if clang.Sysroot != "" {
+		return clang.Sysroot
+	}
+	return clang.gcc().sysroot()
+}
+
+func (clang ClangToolchain) targetName() string {
+	return clang.Target
+}
+
+func (clang ClangToolchain) archName() string {
+	arch := strings.SplitN(clang.Target, "-", 2)[0]
+	if arch == "" {
+		return hostArchName()
+	}
+	if arch == "arm64" {
+		return "aarch64"
+	}
+	return arch
+}
+
+func (clang ClangToolchain) Accepts(tc Toolchain) bool {
+	return clang.gcc().Accepts(tc)
+}
+
+func (clang ClangToolchain) Architecture() Architecture {
+	return clang.gcc().Architecture()
+}
+
+// Freestanding reports whether the toolchain compiles with -ffreestanding or
+// targets a triple without an operating system (e.g. "aarch64-none-elf" or
+// "thumbv7em-none-eabi"). Only the OS and environment components of the triple
+// count, as "none" is also a vendor (e.g. "aarch64-none-linux-gnu").
+func (clang ClangToolchain) Freestanding() bool {
+	for _, flag := range append(append([]string{}, clang.CompilerFlags...), clang.LinkerFlags...) {
+		if flag == "-ffreestanding" {
+			return true
+		}
+	}
+	parts := strings.Split(clang.Target, "-")
+	for i := 2; i < len(parts); i++ {
+		switch parts[i] {
+		case "none", "elf", "eabi", "eabihf":
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectFile generates a compile command.
+func (clang ClangToolchain) ObjectFile(out core.OutPath, depfile core.OutPath, flags []string, includes []core.Path, src core.Path) string {
+	return clang.gcc().ObjectFile(out, depfile, flags, includes, src)
+}
+
+// StaticLibrary generates the command to build a static library.
+func (clang ClangToolchain) StaticLibrary(out core.Path, objs []core.Path) string {
+	return clang.gcc().StaticLibrary(out, objs)
+}
+
+// SharedLibrary generates the command to build a shared library.
+func (clang ClangToolchain) SharedLibrary(out core.Path, objs []core.Path) string {
+	return clang.gcc().SharedLibrary(out, objs)
+}
+
+// SharedLibraryWithFlags generates the command to build a shared library with
+// extra linker flags.
+func (clang ClangToolchain) SharedLibraryWithFlags(out core.Path, objs []core.Path, flags []string) string {
+	return clang.gcc().SharedLibraryWithFlags(out, objs, flags)
+}
+
+// Binary generates the command to build an executable.
+func (clang ClangToolchain) Binary(out core.Path, objs []core.Path, alwaysLinkLibs []core.Path, libs []core.Path, flags []string, script core.Path) string {
+	return clang.gcc().Binary(out, objs, alwaysLinkLibs, libs, flags, script)
+}
+
+// BlobObject creates an object file from any binary blob of data
+func (clang ClangToolchain) BlobObject(out core.OutPath, src core.Path) string {
+	return clang.gcc().BlobObject(out, src)
+}
+
+// RawBinary strips ELF metadata to create a raw binary image
+func (clang ClangToolchain) RawBinary(out core.OutPath, elfSrc core.Path) string {
+	return clang.gcc().RawBinary(out, elfSrc)
+}
+
+func (clang ClangToolchain) StdDeps() []Dep {
+	return clang.Deps
+}
+
+func (clang ClangToolchain) Script() core.Path {
+	return clang.LinkerScript
+}
+
+func (clang ClangToolchain) Name() string {
+	return clang.ToolchainName
+}
@@ -0,0 +1,176 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// ToolchainAttributes are the properties of a toolchain that determine whether
+// code built with it can be linked with code built with another toolchain.
+type ToolchainAttributes struct {
+	Architecture Architecture
+	Freestanding bool
+
+	// The C++ standard library, and thus ABI, e.g. "libstdc++" or "libc++".
+	CxxABI string
+
+	Sanitizer Sanitizer
+
+	// Whether code is instrumented for coverage, or compiled for link-time
+	// optimisation.
+	Coverage bool
+	LTO      bool
+
+	// The compiler, with its version if known, and the flags that apply to
+	// all code it compiles (e.g. -mcpu=). Only known for gcc and clang
+	// toolchains.
+	Compiler      string
+	CompilerFlags []string
+}
+
+// codegenToolchain is implemented by toolchains that know how they generate
+// code.
+type codegenToolchain interface {
+	codegen() (compiler string, flags []string, lto bool)
+}
+
+// ToolchainAttributesOf returns the attributes of the toolchain.
+func ToolchainAttributesOf(toolchain Toolchain) ToolchainAttributes {
+	attrs := ToolchainAttributes{
+		Architecture: ToolchainArchitecture(toolchain),
+		Freestanding: ToolchainFreestanding(toolchain),
+		CxxABI:       "libstdc++",
+		Sanitizer:    SanitizerNone,
+	}
+	if tca, ok := toolchain.(interface{ CxxABI() string }); ok {
+		attrs.CxxABI = tca.CxxABI()
+	}
+	if tcs, ok := toolchain.(interface{ Sanitizer() Sanitizer }); ok {
+		attrs.Sanitizer = tcs.Sanitizer()
+	}
+	if tcc, ok := toolchain.(interface{ Coverage() bool }); ok {
+		attrs.Coverage = tcc.Coverage()
+	}
+	if tcc, ok := toolchain.(codegenToolchain); ok {
+		attrs.Compiler, attrs.CompilerFlags, attrs.LTO = tcc.codegen()
+	}
+	return attrs
+}
+
+// toolchainMismatch explains why the parent toolchain does not accept
+// libraries built with the child toolchain, or returns "" if it does. A
+// toolchain accepts libraries built with itself, with the toolchains it is
+// explicitly compatible with (e.g. GccToolchain.CompatibleWith), and with
+// toolchains of the same attributes.
+func toolchainMismatch(parent, child Toolchain) string {
+	if parent.Name() == child.Name() {
+		return ""
+	}
+	if tca, ok := parent.(interface{ Accepts(tc Toolchain) bool }); ok && tca.Accepts(child) {
+		return ""
+	}
+
+	p, c := ToolchainAttributesOf(parent), ToolchainAttributesOf(child)
+	differs := func(attr string, pv, cv interface{}) string {
+		return fmt.Sprintf("%s differs: %v (toolchain %s) vs %v (toolchain %s)", attr, pv, parent.Name(), cv, child.Name())
+	}
+	switch {
+	case p.Architecture == ArchitectureUnknown || c.Architecture == ArchitectureUnknown:
+		return fmt.Sprintf("the architecture of toolchain %s or %s is unknown, and they are not declared compatible", parent.Name(), child.Name())
+	case p.Architecture != c.Architecture:
+		return differs("architecture", p.Architecture, c.Architecture)
+	case p.Freestanding != c.Freestanding:
+		env := map[bool]string{false: "hosted", true: "freestanding"}
+		return differs("environment", env[p.Freestanding], env[c.Freestanding])
+	case p.CxxABI != c.CxxABI:
+		return differs("C++ ABI", p.CxxABI, c.CxxABI)
+	case p.Sanitizer != c.Sanitizer:
+		return differs("sanitizer", p.Sanitizer, c.Sanitizer)
+	case p.Coverage != c.Coverage:
+		return differs("coverage instrumentation", p.Coverage, c.Coverage)
+	case p.LTO != c.LTO:
+		return differs("link-time optimisation", p.LTO, c.LTO)
+	case p.Compiler != c.Compiler:
+		return differs("compiler", p.Compiler, c.Compiler)
+	case strings.Join(p.CompilerFlags, " ") != strings.Join(c.CompilerFlags, " "):
+		return differs("compiler flags", fmt.Sprintf("%q", p.CompilerFlags), fmt.Sprintf("%q", c.CompilerFlags))
+	}
+	return ""
+}
+
+// CxxABI returns the C++ standard library of the toolchain: CxxStdlib if set,
+// otherwise libc++ if selected with -stdlib=, and libstdc++ by default.
+func (gcc GccToolchain) CxxABI() string {
+	if gcc.CxxStdlib != "" {
+		return gcc.CxxStdlib
+	}
+	for _, flag := range append(append([]string{}, gcc.CompilerFlags...), gcc.CxxFlags...) {
+		if strings.HasPrefix(flag, "-stdlib=") {
+			return strings.TrimPrefix(flag, "-stdlib=")
+		}
+	}
+	return "libstdc++"
+}
+
+// Sanitizer returns the sanitizers the toolchain instruments code with.
+func (gcc GccToolchain) Sanitizer() Sanitizer {
+	sanitizer := SanitizerNone
+	for _, flag := range gcc.CompilerFlags {
+		if strings.HasPrefix(flag, "-fsanitize=") {
+			sanitizer = Sanitizer(strings.TrimPrefix(flag, "-fsanitize="))
+		}
+	}
+	return sanitizer
+}
+
+// Coverage reports whether the toolchain instruments code for coverage.
+func (gcc GccToolchain) Coverage() bool {
+	for _, flag := range gcc.CompilerFlags {
+		if flag == "--coverage" {
+			return true
+		}
+	}
+	return false
+}
+
+func (gcc GccToolchain) codegen() (string, []string, bool) {
+	compiler := ""
+	if gcc.Cxx != nil {
+		compiler = gcc.Cxx.Absolute()
+	} else if gcc.Cc != nil {
+		compiler = gcc.Cc.Absolute()
+	}
+	if gcc.Version != "" {
+		compiler += " " + gcc.Version
+	}
+	return compiler, gcc.CompilerFlags, gcc.LTO
+}
+
+func (clang ClangToolchain) CxxABI() string {
+	return clang.gcc().CxxABI()
+}
+
+func (clang ClangToolchain) Sanitizer() Sanitizer {
+	return clang.gcc().Sanitizer()
+}
+
+func (clang ClangToolchain) Coverage() bool {
+	return clang.gcc().Coverage()
+}
+
+func (clang ClangToolchain) codegen() (string, []string, bool) {
+	return clang.gcc().codegen()
+}
+
+// checkDepToolchain fails with the dependency path if the library can't be
+// used by a target built with the toolchain.
+func checkDepToolchain(toolchain Toolchain, lib Library, path []string) {
+	mismatch := toolchainMismatch(toolchain, toolchainOrDefault(lib.Toolchain))
+	if mismatch == "" {
+		return
+	}
+	core.Fatal("Library %s does not support toolchain %s: %s. Dependency path:\n  %s",
+		lib.Out.Relative(), toolchain.Name(), mismatch, strings.Join(append(path, "lib:"+lib.Out.Relative()), "\n  -> "))
+}
@@ -0,0 +1,104 @@
+package cc
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// ConfigHeader generates a header defining macros from values of the build
+// configuration. Bools define the macro as 1, or undefine it if false. Strings
+// are quoted, numbers are written as they are. The values can also be flags,
+// e.g.:
+//
+//	var Config = cc.ConfigHeader{
+//		Out: out("config.h"),
+//		Macros: map[string]interface{}{
+//			"ENABLE_TRACING": tracingFlag,
+//			"BOARD_NAME":     boardFlag,
+//			"MAX_TASKS":      16,
+//		},
+//	}
+//
+// The header is a Dep, which puts its directory on the include path. It is
+// only rewritten when its content changes, so that changing the value of an
+// unrelated flag doesn't rebuild everything that includes it.
+type ConfigHeader struct {
+	Out    core.OutPath
+	Macros map[string]interface{}
+}
+
+func (header ConfigHeader) content() string {
+	names := []string{}
+	for name := range header.Macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "// Generated from the build configuration. Do not edit.\n#pragma once\n\n")
+	for _, name := range names {
+		value, defined := configMacroValue(header.Macros[name])
+		if !defined {
+			fmt.Fprintf(&b, "#undef %s\n", name)
+		} else {
+			fmt.Fprintf(&b, "#define %s %s\n", name, value)
+		}
+	}
+	return b.String()
+}
+
+// configMacroValue returns the value to define a macro to, or false if the
+// macro must be undefined.
+func configMacroValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case *core.BoolFlag:
+		return configMacroValue(v.Value())
+	case *core.StringFlag:
+		return configMacroValue(v.Value())
+	case *core.IntFlag:
+		return configMacroValue(v.Value())
+	case *core.FloatFlag:
+		return configMacroValue(v.Value())
+	case bool:
+		return "1", v
+	case string:
+		return strconv.Quote(v), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v), true
+	}
+	core.Fatal("Unsupported config header value %v of type %T", value, value)
+	return "", false
+}
+
+// Build a ConfigHeader.
+func (header ConfigHeader) Build(ctx core.Context) {
+	if header.Out == nil {
+		core.Fatal("Out field is required for cc.ConfigHeader")
+	}
+	if ctx.Built(header.Out.Absolute()) {
+		return
+	}
+
+	// The data file is named after the hash of its content, so the copy only
+	// runs again when the content changes.
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   header.Out,
+		Data:  header.content(),
+		Descr: fmt.Sprintf("CONFIG %s", header.Out.Relative()),
+	})
+}
+
+// CcLibrary returns a header-only library for the header.
+func (header ConfigHeader) CcLibrary(toolchain Toolchain) Library {
+	return Library{
+		Out:        header.Out.WithSuffix(".a"),
+		Hdrs:       []core.Path{header.Out},
+		Includes:   []core.Path{core.BuildPath(path.Dir(header.Out.Relative()))},
+		Generators: []Generator{header},
+	}.MultipleToolchains().CcLibrary(toolchain)
+}
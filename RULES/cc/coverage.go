@@ -0,0 +1,110 @@
+package cc
+
+import (
+	"fmt"
+
+	"dbt-rules/RULES/core"
+)
+
+var coverageFlag = core.BoolFlag{
+	Name:        "cc-coverage",
+	Description: "Instrument C/C++ targets built with the default toolchain for code coverage",
+	DefaultFn:   func() bool { return false },
+}.Register()
+
+// CoverageToolchain derives a variant of the toolchain that instruments code
+// for gcov-style coverage (--coverage), which both gcc and clang support.
+func CoverageToolchain(toolchain Toolchain) Toolchain {
+	flags := []string{"--coverage", "-O0", "-g"}
+	return derivedToolchain(toolchain, "cov", flags, []string{"--coverage"})
+}
+
+type CoverageReportScriptParams struct {
+	Tracefile    core.Path
+	HtmlDir      core.Path
+	SourceDir    core.Path
+	BuildDir     core.Path
+	GcovTool     string
+	Tests        []string
+	Instrumented bool
+}
+
+var coverageReportScript = `#!/bin/bash
+set -eu -o pipefail
+
+{{ if not .Instrumented }}
+echo "Coverage reports require the cc-coverage=true flag" >&2
+exit 1
+{{ end }}
+
+TMPDIR=$(mktemp -d -t ci-XXXXXXXXXX)
+trap "rm -rf ${TMPDIR}" EXIT
+
+# Remove counters of previous runs.
+find "{{ .BuildDir }}" -name '*.gcda' -delete
+
+FAILED=0
+{{ range .Tests }}
+{{ . }} || { echo "Test {{ . }} failed" >&2; FAILED=1; }
+{{ end }}
+
+lcov --quiet --gcov-tool "{{ .GcovTool }}" --capture --directory "{{ .BuildDir }}" --base-directory "{{ .SourceDir }}" --output-file ${TMPDIR}/all.info
+lcov --quiet --extract ${TMPDIR}/all.info "{{ .SourceDir }}/*" --output-file ${TMPDIR}/workspace.info
+lcov --quiet --remove ${TMPDIR}/workspace.info "{{ .BuildDir }}/*" --output-file "{{ .Tracefile }}"
+
+rm -rf "{{ .HtmlDir }}"
+genhtml --quiet --output-directory "{{ .HtmlDir }}" "{{ .Tracefile }}"
+
+if [ ${FAILED} -ne 0 ]; then
+    echo "Warning: some tests failed, the coverage report is incomplete" >&2
+fi
+`
+
+// CoverageReport runs test binaries and produces an lcov tracefile and an HTML
+// report of the coverage of workspace sources. The tests must be built with
+// coverage instrumentation, by setting the cc-coverage flag.
+type CoverageReport struct {
+	// The lcov tracefile. The HTML report is generated next to it, in a
+	// directory with the extension ".html".
+	Out core.OutPath
+
+	Tests []Binary
+
+	// The gcov tool matching the compiler, e.g. a wrapper for "llvm-cov gcov"
+	// for clang. Defaults to "gcov".
+	GcovTool string
+}
+
+// Build a CoverageReport.
+func (report CoverageReport) Build(ctx core.Context) {
+	ins := []core.Path{}
+	tests := []string{}
+	for _, test := range report.Tests {
+		test.Build(ctx)
+		ins = append(ins, test.Out)
+		tests = append(tests, test.Run(nil))
+	}
+
+	gcovTool := report.GcovTool
+	if gcovTool == "" {
+		gcovTool = "gcov"
+	}
+
+	htmlDir := report.Out.WithExt("html")
+	data := CoverageReportScriptParams{
+		Tracefile:    report.Out,
+		HtmlDir:      htmlDir,
+		SourceDir:    core.SourcePath(""),
+		BuildDir:     core.BuildPath(""),
+		GcovTool:     gcovTool,
+		Tests:        tests,
+		Instrumented: coverageFlag.Value(),
+	}
+
+	ctx.AddBuildStep(core.BuildStep{
+		Outs:   []core.OutPath{report.Out, htmlDir.WithSuffix("/index.html")},
+		Ins:    ins,
+		Script: core.CompileTemplate(coverageReportScript, "coverage-report-script", data),
+		Descr:  fmt.Sprintf("COVERAGE %s", report.Out.Relative()),
+	})
+}
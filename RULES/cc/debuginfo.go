@@ -0,0 +1,143 @@
+package cc
+
+import (
+	"fmt"
+
+	"dbt-rules/RULES/core"
+)
+
+// debugInfoToolchain is implemented by toolchains that can split the debug info
+// of executables into separate files.
+type debugInfoToolchain interface {
+	DebugInfo(out core.OutPath, elfSrc core.Path) string
+	Strip(out core.OutPath, elfSrc core.Path, debugFile core.Path) string
+}
+
+// DebugInfo extracts the debug info of an executable.
+func (gcc GccToolchain) DebugInfo(out core.OutPath, elfSrc core.Path) string {
+	return fmt.Sprintf("%q --only-keep-debug %q %q", gcc.Objcopy, elfSrc, out)
+}
+
+// Strip removes all symbols and debug info of an executable, and links it to
+// its debug file.
+func (gcc GccToolchain) Strip(out core.OutPath, elfSrc core.Path, debugFile core.Path) string {
+	return fmt.Sprintf("%q --strip-all --add-gnu-debuglink=%q %q %q", gcc.Objcopy, debugFile, elfSrc, out)
+}
+
+func (clang ClangToolchain) DebugInfo(out core.OutPath, elfSrc core.Path) string {
+	return clang.gcc().DebugInfo(out, elfSrc)
+}
+
+func (clang ClangToolchain) Strip(out core.OutPath, elfSrc core.Path, debugFile core.Path) string {
+	return clang.gcc().Strip(out, elfSrc, debugFile)
+}
+
+// DebugFile returns the path of the debug info of the binary, if
+// SplitDebugInfo is set. Sources must be compiled with -g for it to contain
+// more than the symbols.
+func (bin Binary) DebugFile() core.OutPath {
+	return bin.Out.WithSuffix(".debug")
+}
+
+func (bin Binary) unstripped() core.OutPath {
+	return bin.Out.WithSuffix(".unstripped")
+}
+
+func (bin Binary) splitDebugInfo(ctx core.Context, toolchain Toolchain) {
+	debugTc, ok := toolchain.(debugInfoToolchain)
+	if !ok {
+		core.Fatal("Toolchain %s does not support splitting debug info", toolchain.Name())
+		return
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   bin.DebugFile(),
+		In:    bin.unstripped(),
+		Cmd:   debugTc.DebugInfo(bin.DebugFile(), bin.unstripped()),
+		Descr: fmt.Sprintf("OBJCOPY (toolchain: %s) %s", toolchain.Name(), bin.DebugFile().Relative()),
+	})
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   bin.Out,
+		Ins:   []core.Path{bin.unstripped(), bin.DebugFile()},
+		Cmd:   debugTc.Strip(bin.Out, bin.unstripped(), bin.DebugFile()),
+		Descr: fmt.Sprintf("STRIP (toolchain: %s) %s", toolchain.Name(), bin.Out.Relative()),
+	})
+}
+
+type DebugSymbolStoreScriptParams struct {
+	Dir        core.OutPath
+	Index      core.OutPath
+	DebugFiles []core.Path
+}
+
+// The script reads the build-id from the GNU build-id note of every debug file.
+var debugSymbolStoreScript = `#!/usr/bin/env python3
+import os
+import shutil
+import struct
+import sys
+
+` + elfReaderPython + `
+
+def build_id(path):
+    data, e, _, sections = read_elf(path)
+    for section in sections:
+        if section["Name"] == ".note.gnu.build-id":
+            offset = section["Offset"]
+            namesz, descsz, _ = struct.unpack_from(e + "III", data, offset)
+            desc = offset + 12 + (namesz + 3) // 4 * 4
+            return data[desc:desc + descsz].hex()
+    sys.exit("%s has no build-id" % path)
+
+
+store = os.path.join("{{ .Dir }}", ".build-id")
+shutil.rmtree(store, ignore_errors=True)
+
+index = []
+{{ range .DebugFiles }}
+bid = build_id("{{ . }}")
+os.makedirs(os.path.join(store, bid[:2]), exist_ok=True)
+shutil.copyfile("{{ . }}", os.path.join(store, bid[:2], bid[2:] + ".debug"))
+index.append("%s {{ .Relative }}" % bid)
+{{ end }}
+
+with open("{{ .Index }}", "w") as f:
+    f.write("\n".join(index) + "\n")
+`
+
+// DebugSymbolStore collects the debug files of binaries built with
+// SplitDebugInfo into a symbol store keyed by build-id, in the layout of
+// gdb's debug-file-directory: Out/.build-id/xx/yyyy.debug. An index of the
+// build-ids of all binaries is written to Index().
+type DebugSymbolStore struct {
+	Out      core.OutPath
+	Binaries []Binary
+}
+
+// Index returns the path of the index of build-ids.
+func (store DebugSymbolStore) Index() core.OutPath {
+	return store.Out.WithSuffix("/build-ids.txt")
+}
+
+// Build a DebugSymbolStore.
+func (store DebugSymbolStore) Build(ctx core.Context) {
+	debugFiles := []core.Path{}
+	for _, bin := range store.Binaries {
+		if !bin.SplitDebugInfo {
+			core.Fatal("Binary %s in debug symbol store %s must have SplitDebugInfo set", bin.Out.Relative(), store.Out.Relative())
+		}
+		bin.Build(ctx)
+		debugFiles = append(debugFiles, bin.DebugFile())
+	}
+
+	data := DebugSymbolStoreScriptParams{
+		Dir:        store.Out,
+		Index:      store.Index(),
+		DebugFiles: debugFiles,
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:    store.Index(),
+		Ins:    debugFiles,
+		Script: core.CompileTemplate(debugSymbolStoreScript, "debug-symbol-store-script", data),
+		Descr:  fmt.Sprintf("SYMBOLS %s", store.Out.Relative()),
+	})
+}
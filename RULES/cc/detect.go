@@ -0,0 +1,91 @@
+package cc
+
+import (
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// DetectGccToolchain probes the gcc toolchain whose tools are named with the
+// given prefix, e.g. "arm-none-eabi-", or "" for the native toolchain. A
+// prefix containing a directory (e.g. "/opt/gcc-arm/bin/arm-none-eabi-")
+// selects the tools in that directory, otherwise they are looked up on PATH.
+//
+// The architecture and target are taken from -dumpmachine. The toolchain is
+// named after the prefix and the compiler version, e.g.
+// "arm-none-eabi-gcc-12.2.0", so that objects built by different versions of
+// the compiler never mix. The compiler is probed again whenever the build
+// files are generated, which DBT does on every invocation (the run and test
+// arguments are part of them), so upgrading it takes effect on the next build.
+// It reports false if the compiler can't be found.
+func DetectGccToolchain(prefix string) (GccToolchain, bool) {
+	cc, ok := lookupTool(prefix, "gcc")
+	if !ok {
+		return GccToolchain{}, false
+	}
+	machine := probeCompiler(cc, "-dumpmachine")
+	version := probeCompiler(cc, "-dumpfullversion", "-dumpversion")
+
+	requireTool := func(tool string) core.GlobalPath {
+		p, ok := lookupTool(prefix, tool)
+		if !ok {
+			core.Fatal("Found %s, but not %s%s", cc, prefix, tool)
+		}
+		return core.NewGlobalPath(p)
+	}
+	toolchain := GccToolchain{
+		Ar:      requireTool("ar"),
+		As:      requireTool("as"),
+		Cc:      core.NewGlobalPath(cc),
+		Cpp:     core.NewGlobalPath(cc + " -E"),
+		Cxx:     requireTool("g++"),
+		Objcopy: requireTool("objcopy"),
+		Ld:      requireTool("ld"),
+
+		ToolchainName: path.Base(prefix+"gcc") + "-" + version,
+		ArchName:      strings.SplitN(machine, "-", 2)[0],
+		TargetName:    machine,
+		Version:       version,
+	}
+	if size, ok := lookupTool(prefix, "size"); ok {
+		toolchain.Size = core.NewGlobalPath(size)
+	}
+	return toolchain, true
+}
+
+// RegisterDetectedGccToolchain detects a gcc toolchain with DetectGccToolchain
+// and registers it. Besides its versioned name, the toolchain is also
+// registered under the name without version (e.g. "arm-none-eabi-gcc"), so that
+// it can be selected on the command-line independently of the version
+// installed. It reports false if the compiler can't be found.
+func RegisterDetectedGccToolchain(prefix string) (Toolchain, bool) {
+	toolchain, ok := DetectGccToolchain(prefix)
+	if !ok {
+		return nil, false
+	}
+	RegisterToolchain(toolchain)
+	registerToolchainAlias(path.Base(prefix+"gcc"), toolchain)
+	return toolchain, true
+}
+
+func lookupTool(prefix string, tool string) (string, bool) {
+	p, err := exec.LookPath(prefix + tool)
+	if err != nil {
+		return "", false
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return p, true
+}
+
+func probeCompiler(cc string, args ...string) string {
+	out, err := exec.Command(cc, args...).Output()
+	if err != nil {
+		core.Fatal("'%s %s' failed: %s", cc, strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,39 @@
+package cc
+
+// elfReaderPython defines read_elf() for the Python scripts that inspect ELF
+// files. It returns the contents of the file, its byte order (for struct), its
+// PT_LOAD segments as (vaddr, paddr, memsz) tuples, and its sections as dicts
+// with the name and the fields of the section header.
+var elfReaderPython = `
+def read_elf(path):
+    with open(path, "rb") as f:
+        data = f.read()
+    if data[:4] != b"\x7fELF":
+        sys.exit("%s is not an ELF file" % path)
+    is64 = data[4] == 2
+    e = "<" if data[5] == 1 else ">"
+    if is64:
+        phoff, shoff = struct.unpack_from(e + "QQ", data, 0x20)
+        phentsize, phnum, shentsize, shnum, shstrndx = struct.unpack_from(e + "HHHHH", data, 0x36)
+    else:
+        phoff, shoff = struct.unpack_from(e + "II", data, 0x1C)
+        phentsize, phnum, shentsize, shnum, shstrndx = struct.unpack_from(e + "HHHHH", data, 0x2A)
+
+    segments = []
+    for i in range(phnum):
+        if is64:
+            p_type, _, _, vaddr, paddr, _, memsz = struct.unpack_from(e + "IIQQQQQ", data, phoff + i * phentsize)
+        else:
+            p_type, _, vaddr, paddr, _, memsz = struct.unpack_from(e + "IIIIII", data, phoff + i * phentsize)
+        if p_type == 1:  # PT_LOAD
+            segments.append((vaddr, paddr, memsz))
+
+    fmt = e + ("IIQQQQ" if is64 else "IIIIII")
+    headers = [struct.unpack_from(fmt, data, shoff + i * shentsize) for i in range(shnum)]
+    strtab = headers[shstrndx][4]
+    sections = []
+    for name, sh_type, flags, addr, offset, size in headers:
+        name = data[strtab + name:data.index(b"\0", strtab + name)].decode()
+        sections.append({"Name": name, "Type": sh_type, "Flags": flags, "Addr": addr, "Offset": offset, "Size": size})
+    return data, e, segments, sections
+`
@@ -0,0 +1,364 @@
+package cc
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// ExternalBuildSystem is the build system of an external project.
+type ExternalBuildSystem string
+
+const (
+	ExternalCMake     ExternalBuildSystem = "cmake"
+	ExternalAutotools ExternalBuildSystem = "autotools"
+)
+
+// externalToolchain is implemented by toolchains that can describe themselves
+// to external build systems.
+type externalToolchain interface {
+	externalTools() externalTools
+}
+
+type externalTools struct {
+	Cc, Cxx, Ar string
+
+	CFlags, CxxFlags, LdFlags []string
+
+	// The target triple and architecture, if known.
+	Target, Arch string
+
+	Freestanding bool
+
+	// Whether the toolchain builds for another system than the build host,
+	// and the sysroot of that system, if any.
+	Cross   bool
+	Sysroot string
+}
+
+func (gcc GccToolchain) externalTools() externalTools {
+	common := append([]string{}, gcc.CompilerFlags...)
+	if gcc.LTO {
+		common = append([]string{"-flto"}, common...)
+	}
+	for _, include := range gcc.Includes {
+		common = append(common, "-isystem", include.Absolute())
+	}
+	ar := gcc.Ar
+	if gcc.LTO {
+		ar = gcc.ltoAr()
+	}
+	if gcc.Cc == nil {
+		core.Fatal("Toolchain %s has no C compiler for external projects", gcc.Name())
+		return externalTools{}
+	}
+	tools := externalTools{
+		Cc:           gcc.Cc.Absolute(),
+		Cxx:          gcc.Cxx.Absolute(),
+		Ar:           ar.Absolute(),
+		CFlags:       append(append([]string{}, common...), gcc.CFlags...),
+		CxxFlags:     append(append([]string{}, common...), gcc.CxxFlags...),
+		LdFlags:      gcc.linkerFlags(),
+		Target:       gcc.TargetName,
+		Arch:         gcc.ArchName,
+		Freestanding: gcc.Freestanding(),
+		Sysroot:      gcc.sysroot(),
+	}
+	tools.Cross = tools.Freestanding || tools.Sysroot != "" || (tools.Arch != "" && tools.Arch != hostArchName())
+	return tools
+}
+
+func (clang ClangToolchain) externalTools() externalTools {
+	tools := clang.gcc().externalTools()
+	tools.Freestanding = clang.Freestanding()
+	tools.Sysroot = clang.sysroot()
+	tools.Cross = tools.Freestanding || tools.Sysroot != "" || tools.Arch != hostArchName()
+	return tools
+}
+
+type ExternalProjectScriptParams struct {
+	Source        core.Path
+	BuildDir      core.OutPath
+	Prefix        core.OutPath
+	Log           core.OutPath
+	CMake         bool
+	ToolchainFile core.OutPath
+	Env           []string
+	Host          string
+	Options       []string
+}
+
+var externalProjectScript = `#!/bin/bash
+set -eu -o pipefail
+
+rm -rf "{{ .Prefix }}"
+mkdir -p "{{ .BuildDir }}"
+cd "{{ .BuildDir }}"
+
+{{ range .Env }}
+export {{ . }}
+{{ end }}
+
+(
+{{ if .CMake }}
+cmake -S "{{ .Source }}" -B . \
+    -DCMAKE_TOOLCHAIN_FILE="{{ .ToolchainFile }}" \
+    -DCMAKE_INSTALL_PREFIX="{{ .Prefix }}" \
+    -DCMAKE_INSTALL_LIBDIR=lib \
+    -DCMAKE_BUILD_TYPE=Release \
+    {{ range .Options }}{{ . }} {{ end }}
+cmake --build . --parallel "$(nproc)"
+cmake --install .
+{{ else }}
+"{{ .Source }}/configure" --prefix="{{ .Prefix }}" --libdir="{{ .Prefix }}/lib" {{ if .Host }}--host={{ .Host }}{{ end }} \
+    {{ range .Options }}{{ . }} {{ end }}
+make -j "$(nproc)"
+make install
+{{ end }}
+) > "{{ .Log }}" 2>&1 || { cat "{{ .Log }}"; exit 1; }
+`
+
+// ExternalProject builds a third-party project with its own CMake or autotools
+// build, out of tree in the build directory, and installs it to a private
+// prefix. The project is built with the compilers and flags of the toolchain
+// it is used with, passed in a generated CMake toolchain file or in the
+// environment of configure. The declared headers and libraries of the
+// installation are exposed as a Dep.
+type ExternalProject struct {
+	// The installation prefix. Projects built with a toolchain are installed
+	// in a subdirectory named after the toolchain.
+	Out core.OutPath
+
+	// The source directory, containing CMakeLists.txt or configure.
+	Source      core.Path
+	BuildSystem ExternalBuildSystem
+
+	// Extra arguments to cmake or configure, e.g. "-DBUILD_SHARED_LIBS=OFF".
+	Options []string
+
+	// Files of the project whose changes rebuild it, e.g. its sources.
+	Inputs []core.Path
+
+	// Installed headers and libraries, relative to the prefix, e.g.
+	// "include/zlib.h" and "lib/libz.a". Libraries are linked in order.
+	Hdrs []string
+	Libs []string
+
+	// Include directories relative to the prefix. Defaults to "include".
+	Includes []string
+}
+
+func (project ExternalProject) prefix(toolchain Toolchain) core.OutPath {
+	return project.Out.WithPrefix(toolchain.Name() + "/")
+}
+
+func (project ExternalProject) installed(toolchain Toolchain, rel string) core.OutPath {
+	return project.prefix(toolchain).WithSuffix("/" + rel)
+}
+
+// outputs returns the declared headers and libraries of the installation.
+func (project ExternalProject) outputs(toolchain Toolchain) []core.OutPath {
+	outs := []core.OutPath{}
+	for _, rel := range append(append([]string{}, project.Hdrs...), project.Libs...) {
+		outs = append(outs, project.installed(toolchain, rel))
+	}
+	return outs
+}
+
+func (project ExternalProject) build(ctx core.Context, toolchain Toolchain) {
+	if project.Out == nil || project.Source == nil {
+		core.Fatal("Out and Source fields are required for cc.ExternalProject")
+		return
+	}
+	prefix := project.prefix(toolchain)
+	outs := project.outputs(toolchain)
+	if len(outs) == 0 {
+		core.Fatal("External project %s declares no headers or libraries", project.Out.Relative())
+		return
+	}
+	if ctx.Built(outs[0].Absolute()) {
+		return
+	}
+	extTc, ok := toolchain.(externalToolchain)
+	if !ok {
+		core.Fatal("Toolchain %s does not support external projects", toolchain.Name())
+		return
+	}
+	tools := extTc.externalTools()
+
+	data := ExternalProjectScriptParams{
+		Source:   project.Source,
+		BuildDir: prefix.WithSuffix(".build"),
+		Prefix:   prefix,
+		Log:      prefix.WithSuffix(".log"),
+		Options:  project.Options,
+	}
+	ins := append([]core.Path{}, project.Inputs...)
+	switch project.BuildSystem {
+	case ExternalCMake:
+		data.CMake = true
+		data.ToolchainFile = prefix.WithSuffix(".toolchain.cmake")
+		ctx.AddBuildStep(core.BuildStep{
+			Out:  data.ToolchainFile,
+			Data: tools.cmakeToolchainFile(),
+		})
+		ins = append(ins, data.ToolchainFile)
+	case ExternalAutotools:
+		data.Env = tools.environment()
+		if tools.Cross {
+			if tools.Target == "" {
+				core.Fatal("Cannot cross-compile external project %s with toolchain %s, which has no target triple", project.Out.Relative(), toolchain.Name())
+			}
+			data.Host = tools.Target
+		}
+	default:
+		core.Fatal("Unknown build system %q of external project %s", project.BuildSystem, project.Out.Relative())
+	}
+
+	ctx.AddBuildStep(core.BuildStep{
+		Outs:   outs,
+		Ins:    ins,
+		Script: core.CompileTemplate(externalProjectScript, "external-project-script", data),
+		Descr:  fmt.Sprintf("EXTERNAL (toolchain: %s) %s", toolchain.Name(), prefix.Relative()),
+	})
+}
+
+// CcLibrary returns the installed libraries of the project built with the
+// toolchain.
+func (project ExternalProject) CcLibrary(toolchain Toolchain) Library {
+	toolchain = toolchainOrDefault(toolchain)
+	if len(project.Libs) == 0 {
+		core.Fatal("External project %s declares no libraries", project.Out.Relative())
+		return Library{}
+	}
+
+	includes := project.Includes
+	if len(includes) == 0 {
+		includes = []string{"include"}
+	}
+	hdrs := []core.Path{}
+	for _, hdr := range project.Hdrs {
+		hdrs = append(hdrs, project.installed(toolchain, hdr))
+	}
+	includePaths := []core.Path{}
+	for _, include := range includes {
+		includePaths = append(includePaths, project.installed(toolchain, include))
+	}
+
+	// Each library depends on the next one, so they are linked in order.
+	var deps []Dep
+	var lib Library
+	for i := len(project.Libs) - 1; i >= 0; i-- {
+		rel := project.Libs[i]
+		lib = Library{
+			Out:        project.installed(toolchain, rel),
+			Includes:   includePaths,
+			Hdrs:       hdrs,
+			Deps:       deps,
+			Shared:     isSharedLibrary(rel),
+			Toolchain:  toolchain,
+			Generators: []Generator{externalProjectGenerator{project, toolchain}},
+		}
+		deps = []Dep{lib}
+	}
+	return lib
+}
+
+// Build an ExternalProject with the default toolchain.
+func (project ExternalProject) Build(ctx core.Context) {
+	project.build(ctx, DefaultToolchain())
+}
+
+type externalProjectGenerator struct {
+	project   ExternalProject
+	toolchain Toolchain
+}
+
+func (gen externalProjectGenerator) Build(ctx core.Context) {
+	gen.project.build(ctx, gen.toolchain)
+}
+
+func (gen externalProjectGenerator) Outputs() []core.Path {
+	outs := []core.Path{}
+	for _, out := range gen.project.outputs(gen.toolchain) {
+		outs = append(outs, out)
+	}
+	return outs
+}
+
+// environment returns the variables that configure scripts take the tools and
+// flags from.
+func (tools externalTools) environment() []string {
+	vars := [][2]string{
+		{"CC", tools.Cc},
+		{"CXX", tools.Cxx},
+		{"AR", tools.Ar},
+		{"CFLAGS", strings.Join(tools.CFlags, " ")},
+		{"CXXFLAGS", strings.Join(tools.CxxFlags, " ")},
+		{"LDFLAGS", strings.Join(tools.LdFlags, " ")},
+	}
+	env := []string{}
+	for _, v := range vars {
+		env = append(env, fmt.Sprintf("%s='%s'", v[0], strings.ReplaceAll(v[1], "'", `'\''`)))
+	}
+	return env
+}
+
+// cmakeToolchainFile returns a CMake toolchain file selecting the tools and
+// flags.
+func (tools externalTools) cmakeToolchainFile() string {
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+	}
+	b := strings.Builder{}
+	if tools.Cross {
+		// Setting the system name tells CMake that it is cross-compiling.
+		fmt.Fprintf(&b, "set(CMAKE_SYSTEM_NAME %s)\n", tools.cmakeSystemName())
+	}
+	if tools.Freestanding {
+		fmt.Fprintf(&b, "set(CMAKE_TRY_COMPILE_TARGET_TYPE STATIC_LIBRARY)\n")
+	}
+	if tools.Sysroot != "" {
+		fmt.Fprintf(&b, "set(CMAKE_SYSROOT %s)\n", quote(tools.Sysroot))
+		fmt.Fprintf(&b, "set(CMAKE_FIND_ROOT_PATH_MODE_PROGRAM NEVER)\n")
+		for _, kind := range []string{"LIBRARY", "INCLUDE", "PACKAGE"} {
+			fmt.Fprintf(&b, "set(CMAKE_FIND_ROOT_PATH_MODE_%s ONLY)\n", kind)
+		}
+	}
+	if tools.Arch != "" {
+		fmt.Fprintf(&b, "set(CMAKE_SYSTEM_PROCESSOR %s)\n", quote(tools.Arch))
+	}
+	fmt.Fprintf(&b, "set(CMAKE_C_COMPILER %s)\n", quote(tools.Cc))
+	fmt.Fprintf(&b, "set(CMAKE_CXX_COMPILER %s)\n", quote(tools.Cxx))
+	fmt.Fprintf(&b, "set(CMAKE_AR %s)\n", quote(tools.Ar))
+	fmt.Fprintf(&b, "set(CMAKE_C_FLAGS_INIT %s)\n", quote(strings.Join(tools.CFlags, " ")))
+	fmt.Fprintf(&b, "set(CMAKE_CXX_FLAGS_INIT %s)\n", quote(strings.Join(tools.CxxFlags, " ")))
+	for _, kind := range []string{"EXE", "SHARED", "MODULE"} {
+		fmt.Fprintf(&b, "set(CMAKE_%s_LINKER_FLAGS_INIT %s)\n", kind, quote(strings.Join(tools.LdFlags, " ")))
+	}
+	return b.String()
+}
+
+// cmakeSystemName returns the CMAKE_SYSTEM_NAME of the target.
+func (tools externalTools) cmakeSystemName() string {
+	switch {
+	case tools.Freestanding:
+		return "Generic"
+	case strings.Contains(tools.Target, "linux"):
+		return "Linux"
+	case strings.Contains(tools.Target, "darwin") || strings.Contains(tools.Target, "apple"):
+		return "Darwin"
+	case strings.Contains(tools.Target, "windows") || strings.Contains(tools.Target, "mingw"):
+		return "Windows"
+	}
+	// Otherwise, the target is assumed to run the same system as the host.
+	switch runtime.GOOS {
+	case "darwin":
+		return "Darwin"
+	case "windows":
+		return "Windows"
+	}
+	return "Linux"
+}
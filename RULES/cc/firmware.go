@@ -0,0 +1,154 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// FirmwareFormat is the format of a firmware image.
+type FirmwareFormat string
+
+const (
+	FirmwareFormatBin  FirmwareFormat = "bin"
+	FirmwareFormatHex  FirmwareFormat = "ihex"
+	FirmwareFormatSrec FirmwareFormat = "srec"
+)
+
+var firmwareFormatExts = map[FirmwareFormat]string{
+	FirmwareFormatBin:  "bin",
+	FirmwareFormatHex:  "hex",
+	FirmwareFormatSrec: "srec",
+}
+
+// imageToolchain is implemented by toolchains that can convert executables
+// to firmware image formats other than raw binaries, and report their size.
+type imageToolchain interface {
+	Image(out core.OutPath, elfSrc core.Path, format FirmwareFormat) string
+	SizeReport(out core.OutPath, elfSrc core.Path) string
+}
+
+// Image converts an executable to an image in the given format.
+func (gcc GccToolchain) Image(out core.OutPath, elfSrc core.Path, format FirmwareFormat) string {
+	return fmt.Sprintf(
+		"%q -O %s %q %q",
+		gcc.Objcopy,
+		format,
+		elfSrc,
+		out)
+}
+
+// SizeReport writes the sizes of all sections of an executable.
+func (gcc GccToolchain) SizeReport(out core.OutPath, elfSrc core.Path) string {
+	return fmt.Sprintf("%q -A -d %q > %q", gcc.size(), elfSrc, out)
+}
+
+func (gcc GccToolchain) size() core.GlobalPath {
+	if gcc.Size != nil {
+		return gcc.Size
+	}
+	objcopy := gcc.Objcopy.Absolute()
+	if !strings.HasSuffix(objcopy, "objcopy") {
+		core.Fatal("Cannot derive the size tool of toolchain %s from %q, set Size", gcc.Name(), objcopy)
+	}
+	return core.NewGlobalPath(strings.TrimSuffix(objcopy, "objcopy") + "size")
+}
+
+func (clang ClangToolchain) Image(out core.OutPath, elfSrc core.Path, format FirmwareFormat) string {
+	return clang.gcc().Image(out, elfSrc, format)
+}
+
+func (clang ClangToolchain) SizeReport(out core.OutPath, elfSrc core.Path) string {
+	return clang.gcc().SizeReport(out, elfSrc)
+}
+
+// FirmwareImage converts an executable to firmware images, and writes its
+// linker map file and a report of the sizes of its sections. If the binary
+// does not write a map file (see Binary.Map), a copy of it that does is linked
+// in its own output subtree.
+type FirmwareImage struct {
+	Binary Binary
+
+	// Image formats to produce. Defaults to a raw binary.
+	Formats []FirmwareFormat
+}
+
+func (image FirmwareImage) formats() []FirmwareFormat {
+	if len(image.Formats) == 0 {
+		return []FirmwareFormat{FirmwareFormatBin}
+	}
+	return image.Formats
+}
+
+// binary returns the executable to convert, which writes a map file.
+func (image FirmwareImage) binary() Binary {
+	bin := image.Binary
+	if !bin.writesMap() {
+		bin.Map = true
+		bin.Out = bin.Out.WithPrefix("firmware/")
+	}
+	return bin
+}
+
+func (image FirmwareImage) imageOut(format FirmwareFormat) core.OutPath {
+	ext, ok := firmwareFormatExts[format]
+	if !ok {
+		core.Fatal("Unknown firmware format %q", format)
+	}
+	return image.Binary.Out.WithExt(ext)
+}
+
+func (image FirmwareImage) sizeReport() core.OutPath {
+	return image.Binary.Out.WithSuffix(".size")
+}
+
+// Build a FirmwareImage.
+func (image FirmwareImage) Build(ctx core.Context) {
+	if image.Binary.Out == nil {
+		core.Fatal("Binary field is required for cc.FirmwareImage")
+	}
+	bin := image.binary()
+	bin.Build(ctx)
+
+	toolchain := toolchainOrDefault(bin.Toolchain)
+	imageTc, hasImages := toolchain.(imageToolchain)
+
+	for _, format := range image.formats() {
+		out := image.imageOut(format)
+		var cmd string
+		if format == FirmwareFormatBin {
+			cmd = toolchain.RawBinary(out, bin.Out)
+		} else if hasImages {
+			cmd = imageTc.Image(out, bin.Out, format)
+		} else {
+			core.Fatal("Toolchain %s does not support %s firmware images", toolchain.Name(), format)
+		}
+		ctx.AddBuildStep(core.BuildStep{
+			Out:   out,
+			In:    bin.Out,
+			Cmd:   cmd,
+			Descr: fmt.Sprintf("OBJCOPY (toolchain: %s) %s", toolchain.Name(), out.Relative()),
+		})
+	}
+
+	if !hasImages {
+		core.Fatal("Toolchain %s does not support size reports", toolchain.Name())
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   image.sizeReport(),
+		In:    bin.Out,
+		Cmd:   imageTc.SizeReport(image.sizeReport(), bin.Out),
+		Descr: fmt.Sprintf("SIZE (toolchain: %s) %s", toolchain.Name(), image.sizeReport().Relative()),
+	})
+}
+
+// Outputs returns the executable, its map file, the images and the size report.
+func (image FirmwareImage) Outputs() []core.Path {
+	bin := image.binary()
+	outs := []core.Path{bin.Out, bin.MapFile()}
+	for _, format := range image.formats() {
+		outs = append(outs, image.imageOut(format))
+	}
+	return append(outs, image.sizeReport())
+}
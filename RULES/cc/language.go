@@ -0,0 +1,71 @@
+package cc
+
+import (
+	"path"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// Language is the language of a source file.
+type Language string
+
+const (
+	LanguageC   Language = "c"
+	LanguageCxx Language = "c++"
+
+	// Assembly that is run through the C preprocessor first (.S, .sx).
+	LanguageAssemblyWithCpp Language = "assembler-with-cpp"
+
+	// Raw assembly (.s).
+	LanguageAssembly Language = "assembler"
+)
+
+// SourceLanguage detects the language of a source file from its extension.
+// Anything that is not C or assembly is compiled as C++.
+func SourceLanguage(src core.Path) Language {
+	switch path.Ext(src.Relative()) {
+	case ".c":
+		return LanguageC
+	case ".S", ".sx":
+		return LanguageAssemblyWithCpp
+	case ".s":
+		return LanguageAssembly
+	}
+	return LanguageCxx
+}
+
+// compilerFlags are the flags a rule adds when compiling its sources. Common
+// flags apply to sources of all languages.
+type compilerFlags struct {
+	Common []string
+	C      []string
+	Cxx    []string
+	As     []string
+}
+
+// isCxxStandardFlag reports whether the flag selects a C++ standard, e.g.
+// -std=c++14 or -std=gnu++17.
+func isCxxStandardFlag(flag string) bool {
+	return strings.HasPrefix(flag, "-std=c++") || strings.HasPrefix(flag, "-std=gnu++")
+}
+
+// forSource returns the flags for compiling the source. C++ standards among the
+// common flags only apply to C++ sources, as they were common flags before
+// languages had their own.
+func (flags compilerFlags) forSource(src core.Path) []string {
+	language := SourceLanguage(src)
+	result := []string{}
+	for _, flag := range flags.Common {
+		if language == LanguageCxx || !isCxxStandardFlag(flag) {
+			result = append(result, flag)
+		}
+	}
+	switch language {
+	case LanguageC:
+		return append(result, flags.C...)
+	case LanguageAssembly, LanguageAssemblyWithCpp:
+		return append(result, flags.As...)
+	}
+	return append(result, flags.Cxx...)
+}
@@ -0,0 +1,186 @@
+package cc
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"dbt-rules/RULES/core"
+)
+
+var layeringCheckFlag = core.StringFlag{
+	Name:          "cc-layering-check",
+	Description:   "Check that C/C++ targets only include headers of their own or of direct dependencies",
+	DefaultFn:     func() string { return "off" },
+	AllowedValues: []string{"off", "warn", "error"},
+}.Register()
+
+type LayeringCheckScriptParams struct {
+	Config string
+	Out    core.OutPath
+	Strict bool
+}
+
+// The script resolves the includes of every source file (and of the target's
+// own headers) through the depfile written by the compiler. Only headers that
+// the target includes itself are checked, so headers that a dependency
+// includes from its own dependencies are not reported.
+var layeringCheckScript = `#!/usr/bin/env python3
+import json
+import os
+import re
+import sys
+
+config = json.loads(r'''{{ .Config }}''')
+INCLUDE = re.compile(r'^\s*#\s*include\s*[<"]([^>"]+)[>"]')
+
+
+def in_dir(path, directory):
+    return path.startswith(directory.rstrip("/") + "/")
+
+
+def owns(owner, path):
+    return (path in owner["Hdrs"]
+            or os.path.dirname(path) in owner["Dirs"]
+            or any(in_dir(path, d) for d in owner["IncludeDirs"]))
+
+
+def read_depfile(depfile):
+    with open(depfile) as f:
+        content = f.read().replace("\\\n", " ")
+    content = content.split(":", 1)[1] if ":" in content else ""
+    deps = re.split(r"(?<!\\)\s+", content.strip())
+    return [os.path.normpath(d.replace("\\ ", " ")) for d in deps if d]
+
+
+def includes(path):
+    try:
+        with open(path, errors="replace") as f:
+            for line in f:
+                match = INCLUDE.match(line)
+                if match:
+                    yield match.group(1)
+    except OSError:
+        pass
+
+
+own = config["Own"]
+violations = []
+for source in config["Sources"]:
+    deps = read_depfile(source["Depfile"])
+    files = [source["Src"]] + [d for d in deps if owns(own, d)]
+    for path in files:
+        for name in includes(path):
+            candidates = [d for d in deps if d == os.path.normpath(os.path.join(os.path.dirname(path), name))
+                          or d.endswith("/" + name)]
+            if not candidates:
+                continue
+            header = candidates[0]
+            if not in_dir(header, config["SourceDir"]) or in_dir(header, config["BuildDir"]):
+                continue
+            if owns(own, header) or any(owns(dep, header) for dep in config["Deps"]):
+                continue
+            violations.append((path, name, header))
+
+lines = []
+for path, name, header in sorted(set(violations)):
+    lines.append("%s: includes \"%s\" (%s), which belongs to no direct dependency" % (path, name, header))
+
+with open("{{ .Out }}", "w") as f:
+    f.write("\n".join(lines))
+
+if lines:
+    print("Layering violations in %s:\n  %s" % (config["Target"], "\n  ".join(lines)))
+    {{ if .Strict }}sys.exit(1){{ end }}
+`
+
+// headerOwner describes the headers that belong to a library or binary: the
+// headers listed in Hdrs, those in the directories of its sources and those
+// under its include directories.
+type headerOwner struct {
+	Hdrs        []string
+	Dirs        []string
+	IncludeDirs []string
+}
+
+func newHeaderOwner(srcs []core.Path, hdrs []core.Path, includes []core.Path) headerOwner {
+	owner := headerOwner{Hdrs: []string{}, Dirs: []string{}, IncludeDirs: []string{}}
+	for _, hdr := range hdrs {
+		owner.Hdrs = append(owner.Hdrs, hdr.Absolute())
+	}
+	for _, src := range srcs {
+		owner.Dirs = append(owner.Dirs, path.Dir(src.Absolute()))
+	}
+	for _, include := range includes {
+		// The workspace root is on the include path of everything, so it
+		// doesn't make headers belong to anyone.
+		if include.Absolute() != core.SourcePath("").Absolute() {
+			owner.IncludeDirs = append(owner.IncludeDirs, include.Absolute())
+		}
+	}
+	return owner
+}
+
+func (lib Library) headerOwner() headerOwner {
+	return newHeaderOwner(lib.Srcs, lib.Hdrs, append(append([]core.Path{}, lib.Includes...), lib.PrivateIncludes...))
+}
+
+type layeringSource struct {
+	Src     string
+	Depfile string
+}
+
+type layeringConfig struct {
+	Target    string
+	SourceDir string
+	BuildDir  string
+	Sources   []layeringSource
+	Own       headerOwner
+	Deps      []headerOwner
+}
+
+// checkLayering adds a step checking that the sources only include headers of
+// their own target or of its direct deps (and the toolchain's standard deps).
+func checkLayering(ctx core.Context, out core.OutPath, srcs []core.Path, objs []core.Path, own headerOwner, directDeps []Dep, toolchain Toolchain) {
+	if layeringCheckFlag.Value() == "off" || len(srcs) == 0 {
+		return
+	}
+
+	config := layeringConfig{
+		Target:    out.Relative(),
+		SourceDir: core.SourcePath("").Absolute(),
+		BuildDir:  core.BuildPath("").Absolute(),
+		Sources:   []layeringSource{},
+		Own:       own,
+		Deps:      []headerOwner{},
+	}
+	for i, src := range srcs {
+		// Raw assembly has no includes, and no depfile.
+		if SourceLanguage(src) == LanguageAssembly {
+			continue
+		}
+		depfile := objs[i].WithExt("d")
+		config.Sources = append(config.Sources, layeringSource{Src: src.Absolute(), Depfile: depfile.Absolute()})
+	}
+	for _, dep := range append(append([]Dep{}, directDeps...), toolchain.StdDeps()...) {
+		config.Deps = append(config.Deps, dep.CcLibrary(toolchain).headerOwner())
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		core.Fatal("failed to marshal layering check config: %s", err)
+	}
+
+	report := out.WithSuffix(".layering")
+	params := LayeringCheckScriptParams{
+		Config: string(data),
+		Out:    report,
+		Strict: layeringCheckFlag.Value() == "error",
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:    report,
+		Ins:    objs[:len(srcs)],
+		Script: core.CompileTemplate(layeringCheckScript, "layering-check-script", params),
+		Descr:  fmt.Sprintf("LAYERING %s", out.Relative()),
+	})
+}
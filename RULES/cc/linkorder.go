@@ -0,0 +1,180 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// depCollector collects the transitive deps of a target. It finds the strongly
+// connected components of the dependency graph (i.e. the dependency cycles)
+// with Tarjan's algorithm, which also sorts them topologically.
+type depCollector struct {
+	toolchain Toolchain
+
+	index   map[string]int
+	lowlink map[string]int
+	onStack map[string]bool
+	stack   []Library
+	edges   map[string][]string
+	names   map[string]string
+
+	// Components in reverse topological order: each after all it depends on.
+	components [][]Library
+}
+
+func (c *depCollector) visit(dep Dep, path []string) Library {
+	lib, isLib := dep.(Library)
+	if !isLib {
+		// Other deps return a library tied to a toolchain they support.
+		lib = dep.CcLibrary(c.toolchain)
+	}
+	checkDepToolchain(c.toolchain, lib, path)
+	key := lib.Out.Absolute()
+	if _, visited := c.index[key]; visited {
+		return lib
+	}
+
+	c.names[key] = "lib:" + lib.Out.Relative()
+	c.index[key] = len(c.index)
+	c.lowlink[key] = c.index[key]
+	c.stack = append(c.stack, lib)
+	c.onStack[key] = true
+
+	// Like the top-level deps, the deps of the library are visited backwards.
+	libPath := append(append([]string{}, path...), c.names[key])
+	for i := len(lib.Deps) - 1; i >= 0; i-- {
+		childKey := c.visit(lib.Deps[i], libPath).Out.Absolute()
+		c.edges[key] = append(c.edges[key], childKey)
+		if c.onStack[childKey] && c.lowlink[childKey] < c.lowlink[key] {
+			c.lowlink[key] = c.lowlink[childKey]
+		}
+	}
+
+	if c.lowlink[key] == c.index[key] {
+		i := len(c.stack) - 1
+		for c.stack[i].Out.Absolute() != key {
+			i--
+		}
+		component := append([]Library{}, c.stack[i:]...)
+		for _, member := range component {
+			c.onStack[member.Out.Absolute()] = false
+		}
+		c.stack = c.stack[:i]
+		c.components = append(c.components, component)
+	}
+	return lib
+}
+
+// cycle returns a dependency cycle through the first library of a component,
+// or nil if the component is not cyclic.
+func (c *depCollector) cycle(component []Library) []string {
+	inComponent := map[string]bool{}
+	for _, lib := range component {
+		inComponent[lib.Out.Absolute()] = true
+	}
+	start := component[0].Out.Absolute()
+
+	// Breadth-first search for the shortest path back to the start.
+	prev := map[string]string{}
+	queue := []string{start}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, next := range c.edges[node] {
+			if next == start {
+				cycle := []string{start}
+				for n := node; n != start; n = prev[n] {
+					cycle = append([]string{n}, cycle...)
+				}
+				return append([]string{start}, cycle...)
+			}
+			if _, seen := prev[next]; !seen && inComponent[next] {
+				prev[next] = node
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// collectDepsWithToolchain returns the deps and their transitive deps, built
+// with the toolchain, in link order: every library comes before the libraries
+// it depends on, and deps that don't depend on each other stay in the order
+// given. Errors about incompatible deps or dependency cycles show the path to
+// them from the trace of the context.
+//
+// Libraries of a dependency cycle must all set AllowCyclicDeps. They are
+// returned next to each other, and with the same non-zero link group in the
+// map from the outputs of libraries to their link groups.
+func collectDepsWithToolchain(ctx core.Context, toolchain Toolchain, deps []Dep) ([]Library, map[string]int) {
+	c := &depCollector{
+		toolchain: toolchain,
+		index:     map[string]int{},
+		lowlink:   map[string]int{},
+		onStack:   map[string]bool{},
+		edges:     map[string][]string{},
+		names:     map[string]string{},
+	}
+	// Visiting the deps backwards keeps unrelated deps in order once the
+	// result is reversed.
+	for i := len(deps) - 1; i >= 0; i-- {
+		c.visit(deps[i], ctx.Trace())
+	}
+
+	result := []Library{}
+	linkGroups := map[string]int{}
+	for i := len(c.components) - 1; i >= 0; i-- {
+		component := c.components[i]
+		cycle := c.cycle(component)
+		if cycle != nil {
+			for _, lib := range component {
+				if !lib.AllowCyclicDeps {
+					names := []string{}
+					for _, key := range cycle {
+						names = append(names, c.names[key])
+					}
+					core.Fatal("Dependency cycle: %s. Set AllowCyclicDeps on all libraries of the cycle if it is intentional. Dependency path:\n  %s",
+						strings.Join(names, " -> "), strings.Join(append(ctx.Trace(), names[0]), "\n  -> "))
+				}
+				linkGroups[lib.Out.Absolute()] = i + 1
+				result = append(result, lib)
+			}
+			continue
+		}
+		result = append(result, component...)
+	}
+	return result, linkGroups
+}
+
+// linkLine splits the libraries to link into those passed as libraries to the
+// toolchain, and those passed as linker flags. Libraries of a dependency cycle
+// are wrapped in --start-group and --end-group, so the linker searches them
+// repeatedly. As toolchains link libraries before the other flags, the
+// libraries from the first group on are passed as flags.
+func linkLine(libs []Library, linkGroups map[string]int) ([]core.Path, []string) {
+	paths := []core.Path{}
+	flags := []string{}
+	group := 0
+	for _, lib := range libs {
+		if libGroup := linkGroups[lib.Out.Absolute()]; libGroup != group {
+			if group != 0 {
+				flags = append(flags, "-Wl,--end-group")
+			}
+			if libGroup != 0 {
+				flags = append(flags, "-Wl,--start-group")
+			}
+			group = libGroup
+		}
+		if len(flags) == 0 {
+			paths = append(paths, lib.Out)
+		} else {
+			flags = append(flags, fmt.Sprintf("%q", lib.Out))
+		}
+	}
+	if group != 0 {
+		flags = append(flags, "-Wl,--end-group")
+	}
+	return paths, flags
+}
@@ -0,0 +1,112 @@
+package cc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+var lintFlag = core.StringFlag{
+	Name:          "cc-lint",
+	Description:   "Lint C/C++ sources: off, warn (report findings) or error (findings fail the build)",
+	DefaultFn:     func() string { return "off" },
+	AllowedValues: []string{"off", "warn", "error"},
+}.Register()
+
+var lintToolFlag = core.StringFlag{
+	Name:          "cc-lint-tool",
+	Description:   "Static analyser used to lint C/C++ sources",
+	DefaultFn:     func() string { return "clang-tidy" },
+	AllowedValues: []string{"clang-tidy", "cppcheck"},
+}.Register()
+
+func lintEnabled() bool {
+	return lintFlag.Value() != "off"
+}
+
+// compileCommand is an entry of a compilation database (compile_commands.json).
+type compileCommand struct {
+	Directory string `json:"directory"`
+	Command   string `json:"command"`
+	File      string `json:"file"`
+	Output    string `json:"output"`
+}
+
+// lint adds the steps to lint the source of the object file, and returns the
+// log of the findings. The linter gets the exact compile command through a
+// compilation database, except that forceInclude replaces the precompiled
+// header, which only the compiler can read.
+func (obj ObjectFile) lint(ctx core.Context, forceInclude core.Path) core.OutPath {
+	log := obj.out().WithExt("lint.log")
+	if ctx.Built(log.Absolute()) {
+		return log
+	}
+
+	lintObj := obj
+	if obj.PrecompiledHeader != nil {
+		lintObj.PrecompiledHeader = nil
+		lintObj.Flags = append([]string{"-include", fmt.Sprintf("%q", forceInclude)}, obj.Flags...)
+	}
+
+	data, err := json.MarshalIndent([]compileCommand{{
+		Directory: core.SourcePath("").Absolute(),
+		Command:   lintObj.command(),
+		File:      obj.Src.Absolute(),
+		Output:    obj.out().Absolute(),
+	}}, "", "  ")
+	if err != nil {
+		core.Fatal("failed to marshal compilation database: %s", err)
+	}
+	dbDir := obj.out().WithExt("lint")
+	db := dbDir.WithSuffix("/compile_commands.json")
+	ctx.AddBuildStep(core.BuildStep{
+		Out:  db,
+		Data: string(data),
+	})
+
+	strict := lintFlag.Value() == "error"
+	var cmd string
+	switch lintToolFlag.Value() {
+	case "clang-tidy":
+		args := []string{"--quiet", fmt.Sprintf("-p %q", dbDir)}
+		if strict {
+			args = append(args, "--warnings-as-errors='*'")
+		}
+		cmd = fmt.Sprintf("clang-tidy %s %q > %q 2>&1", strings.Join(args, " "), obj.Src, log)
+	case "cppcheck":
+		args := []string{"--quiet", "--enable=warning,style,performance,portability", "--template=gcc", fmt.Sprintf("--project=%q", db)}
+		if strict {
+			args = append(args, "--error-exitcode=1")
+		}
+		cmd = fmt.Sprintf("cppcheck %s 2> %q", strings.Join(args, " "), log)
+	}
+	if strict {
+		cmd = fmt.Sprintf("%s || { cat %q; exit 1; }", cmd, log)
+	} else {
+		cmd = fmt.Sprintf("%s ; cat %q", cmd, log)
+	}
+
+	// The object is an input so that the linter runs again whenever any of
+	// the headers of the source changes.
+	ctx.AddBuildStep(core.BuildStep{
+		Out:       log,
+		In:        obj.Src,
+		Ins:       []core.Path{db, obj.out()},
+		OrderOnly: obj.OrderOnly,
+		Cmd:       cmd,
+		Descr:     fmt.Sprintf("LINT (%s) %s", lintToolFlag.Value(), obj.Src.Relative()),
+	})
+	return log
+}
+
+// lintReport collects the lint findings of all sources of a target.
+func lintReport(ctx core.Context, out core.OutPath, logs []core.Path) {
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   out,
+		Ins:   logs,
+		Cmd:   fmt.Sprintf("cat %s > %q", joinQuoted(logs), out),
+		Descr: fmt.Sprintf("LINT REPORT %s", out.Relative()),
+	})
+}
@@ -0,0 +1,112 @@
+package cc
+
+import (
+	"sort"
+
+	"dbt-rules/RULES/core"
+)
+
+// ToolchainMatrix builds a library or binary with each of several toolchains,
+// e.g. to check that a portable library builds everywhere. The variant built
+// with a toolchain goes to a subdirectory named after the toolchain.
+type ToolchainMatrix struct {
+	// A Library, a Binary, or a library returned by Library.MultipleToolchains().
+	Target interface{}
+
+	// Defaults to all registered toolchains that the deps of the target support.
+	Toolchains []Toolchain
+}
+
+// variants returns the library or binary for every toolchain of the matrix.
+func (matrix ToolchainMatrix) variants() []interface{ Build(ctx core.Context) } {
+	variants := []interface{ Build(ctx core.Context) }{}
+	for _, toolchain := range matrix.toolchains() {
+		prefix := toolchain.Name() + "/"
+		switch target := matrix.Target.(type) {
+		case Library:
+			target.Out = target.Out.WithPrefix(prefix)
+			target.Toolchain = toolchain
+			variants = append(variants, target)
+		case multipleToolchainLibrary:
+			lib := target.lib
+			lib.Out = target.baseOut.WithPrefix(prefix)
+			lib.Toolchain = toolchain
+			variants = append(variants, lib)
+		case Binary:
+			target.Out = target.Out.WithPrefix(prefix)
+			target.Toolchain = toolchain
+			variants = append(variants, target)
+		default:
+			core.Fatal("cc.ToolchainMatrix does not support targets of type %T", matrix.Target)
+		}
+	}
+	return variants
+}
+
+func (matrix ToolchainMatrix) deps() []Dep {
+	switch target := matrix.Target.(type) {
+	case Library:
+		return target.Deps
+	case multipleToolchainLibrary:
+		return target.lib.Deps
+	case Binary:
+		return target.Deps
+	}
+	core.Fatal("cc.ToolchainMatrix does not support targets of type %T", matrix.Target)
+	return nil
+}
+
+func (matrix ToolchainMatrix) toolchains() []Toolchain {
+	if len(matrix.Toolchains) > 0 {
+		return matrix.Toolchains
+	}
+
+	// Toolchains can be registered under several names.
+	names := []string{}
+	byName := map[string]Toolchain{}
+	for _, toolchain := range toolchains {
+		if _, found := byName[toolchain.Name()]; !found {
+			names = append(names, toolchain.Name())
+			byName[toolchain.Name()] = toolchain
+		}
+	}
+	sort.Strings(names)
+
+	deps := matrix.deps()
+	result := []Toolchain{}
+	for _, name := range names {
+		if depsSupportToolchain(byName[name], deps) {
+			result = append(result, byName[name])
+		}
+	}
+	return result
+}
+
+// depsSupportToolchain reports whether all deps, and their own deps, can be
+// built with the toolchain. Only libraries tied to a toolchain restrict it.
+func depsSupportToolchain(toolchain Toolchain, deps []Dep) bool {
+	for _, dep := range deps {
+		switch lib := dep.(type) {
+		case Library:
+			if !ToolchainAccepts(toolchain, toolchainOrDefault(lib.Toolchain)) || !depsSupportToolchain(toolchain, lib.Deps) {
+				return false
+			}
+		case multipleToolchainLibrary:
+			if !depsSupportToolchain(toolchain, lib.lib.Deps) {
+				return false
+			}
+		case PrebuiltLibrary:
+			if (lib.Toolchain != nil && !ToolchainAccepts(toolchain, lib.Toolchain)) || !depsSupportToolchain(toolchain, lib.Deps) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Build all variants of a ToolchainMatrix.
+func (matrix ToolchainMatrix) Build(ctx core.Context) {
+	for _, variant := range matrix.variants() {
+		variant.Build(ctx)
+	}
+}
@@ -0,0 +1,100 @@
+package cc
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// precompiledHeaderToolchain is implemented by toolchains that support
+// precompiled headers.
+type precompiledHeaderToolchain interface {
+	// PrecompiledHeaderExt returns the extension of precompiled headers.
+	PrecompiledHeaderExt() string
+
+	// PrecompiledHeader generates the command to precompile a C++ header.
+	PrecompiledHeader(out core.OutPath, depfile core.OutPath, flags []string, includes []core.Path, src core.Path) string
+
+	// UsePrecompiledHeader returns the compiler flags to force-include a
+	// precompiled header.
+	UsePrecompiledHeader(pch core.Path) []string
+}
+
+// buildPrecompiledHeader precompiles opts.PrecompiledHeader with the flags used
+// for C++ sources. It returns the header including opts.PrecompiledHeader, and
+// the path to pass as ObjectFile.PrecompiledHeader.
+func buildPrecompiledHeader(ctx core.Context, opts compileOptions, flags compilerFlags, includes []core.Path, hdrs []core.Path, toolchain Toolchain) (core.Path, core.Path) {
+	pchFlags := flags.forSource(opts.PrecompiledHeader)
+	if opts.PIC {
+		pchFlags = append([]string{"-fPIC"}, pchFlags...)
+	}
+	// Like objects, precompiled headers go to a directory of the toolchain,
+	// and they are also named after a hash of the flags.
+	key := crc32.ChecksumIEEE([]byte(strings.Join(pchFlags, " ") + " " + joinQuoted(includes)))
+
+	// The header is included through a wrapper next to the precompiled header,
+	// as gcc only finds precompiled headers next to the included file.
+	wrapper := opts.PrecompiledHeaderOut.WithPrefix(toolchain.Name() + "/").WithSuffix(fmt.Sprintf(".%08X.h", key))
+	ctx.AddBuildStep(core.BuildStep{
+		Out:  wrapper,
+		Data: fmt.Sprintf("#include \"%s\"\n", opts.PrecompiledHeader.Absolute()),
+	})
+
+	tc, ok := toolchain.(precompiledHeaderToolchain)
+	if !ok {
+		return wrapper, wrapper
+	}
+
+	pch := wrapper.WithSuffix("." + tc.PrecompiledHeaderExt())
+	depfile := pch.WithSuffix(".d")
+	ctx.AddBuildStep(core.BuildStep{
+		Out:       pch,
+		Depfile:   depfile,
+		In:        wrapper,
+		OrderOnly: hdrs,
+		Cmd:       tc.PrecompiledHeader(pch, depfile, pchFlags, includes, wrapper),
+		Descr:     fmt.Sprintf("PCH (toolchain: %s) %s", toolchain.Name(), pch.Relative()),
+	})
+	return wrapper, pch
+}
+
+// usePrecompiledHeaderFlags returns the compiler flags to use a precompiled
+// header, or to just force-include the header if the toolchain doesn't
+// support precompiled headers.
+func usePrecompiledHeaderFlags(toolchain Toolchain, pch core.Path) []string {
+	if tc, ok := toolchain.(precompiledHeaderToolchain); ok {
+		return tc.UsePrecompiledHeader(pch)
+	}
+	return []string{"-include", fmt.Sprintf("%q", pch)}
+}
+
+func (gcc GccToolchain) PrecompiledHeaderExt() string {
+	return "gch"
+}
+
+// PrecompiledHeader generates the command to precompile a C++ header.
+func (gcc GccToolchain) PrecompiledHeader(out core.OutPath, depfile core.OutPath, flags []string, includes []core.Path, src core.Path) string {
+	return gcc.ObjectFile(out, depfile, append([]string{"-x", "c++-header"}, flags...), includes, src)
+}
+
+// UsePrecompiledHeader includes the header next to the precompiled header,
+// which gcc replaces by the precompiled header.
+func (gcc GccToolchain) UsePrecompiledHeader(pch core.Path) []string {
+	header := strings.TrimSuffix(pch.Absolute(), "."+gcc.PrecompiledHeaderExt())
+	return []string{"-include", fmt.Sprintf("%q", header), "-Winvalid-pch"}
+}
+
+func (clang ClangToolchain) PrecompiledHeaderExt() string {
+	return "pch"
+}
+
+// PrecompiledHeader generates the command to precompile a C++ header.
+func (clang ClangToolchain) PrecompiledHeader(out core.OutPath, depfile core.OutPath, flags []string, includes []core.Path, src core.Path) string {
+	return clang.gcc().PrecompiledHeader(out, depfile, flags, includes, src)
+}
+
+func (clang ClangToolchain) UsePrecompiledHeader(pch core.Path) []string {
+	return []string{"-include-pch", fmt.Sprintf("%q", pch)}
+}
@@ -0,0 +1,219 @@
+package cc
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// PrebuiltLibrary is a Dep on an existing static or shared library, e.g. one
+// supplied by a vendor. The library is copied to the build directory, so that
+// binaries find shared libraries relative to themselves like built ones.
+type PrebuiltLibrary struct {
+	// The .a or .so file.
+	Lib core.Path
+
+	Includes          []core.Path
+	Defines           []string
+	PublicLinkerFlags []string
+	Deps              []Dep
+	AlwaysLink        bool
+
+	// Soname of a shared library. Defaults to the DT_SONAME of Lib, or its
+	// base name if it has none.
+	Soname string
+
+	// The toolchain the library was built with. If nil, the library is
+	// assumed to work with any toolchain.
+	Toolchain Toolchain
+}
+
+// isSharedLibrary reports whether the path names a shared library, possibly
+// versioned (e.g. libfoo.so.1).
+func isSharedLibrary(p string) bool {
+	base := path.Base(p)
+	return strings.HasSuffix(base, ".so") || strings.Contains(base, ".so.")
+}
+
+// CcLibrary returns the library for the toolchain.
+func (prebuilt PrebuiltLibrary) CcLibrary(toolchain Toolchain) Library {
+	// Targets check that they accept the toolchain of the library.
+	toolchain = toolchainOrDefault(toolchain)
+	if prebuilt.Toolchain != nil {
+		toolchain = prebuilt.Toolchain
+	}
+	return Library{
+		Out:               prebuilt.out(),
+		Includes:          prebuilt.Includes,
+		Defines:           prebuilt.Defines,
+		PublicLinkerFlags: prebuilt.PublicLinkerFlags,
+		Deps:              prebuilt.Deps,
+		Shared:            isSharedLibrary(prebuilt.Lib.Relative()),
+		AlwaysLink:        prebuilt.AlwaysLink,
+		Soname:            prebuilt.soname(),
+		Toolchain:         toolchain,
+		Generators:        []Generator{prebuiltLibraryCopy{prebuilt}},
+	}
+}
+
+// soname returns the soname of a shared library, as recorded in it if not set.
+func (prebuilt PrebuiltLibrary) soname() string {
+	if prebuilt.Soname != "" || !isSharedLibrary(prebuilt.Lib.Relative()) {
+		return prebuilt.Soname
+	}
+	if _, generated := prebuilt.Lib.(core.OutPath); generated {
+		return ""
+	}
+	f, err := elf.Open(prebuilt.Lib.Absolute())
+	if err != nil {
+		core.Fatal("Cannot read prebuilt library %s: %s", prebuilt.Lib.Relative(), err)
+		return ""
+	}
+	defer f.Close()
+	sonames, err := f.DynString(elf.DT_SONAME)
+	if err != nil || len(sonames) == 0 {
+		return ""
+	}
+	return sonames[0]
+}
+
+// Build a PrebuiltLibrary.
+func (prebuilt PrebuiltLibrary) Build(ctx core.Context) {
+	prebuilt.CcLibrary(DefaultToolchain()).Build(ctx)
+}
+
+func (prebuilt PrebuiltLibrary) out() core.OutPath {
+	return prebuilt.Lib.WithPrefix("prebuilt/")
+}
+
+// prebuiltLibraryCopy copies a prebuilt library to the build directory, and
+// creates the symlinks of a shared library.
+type prebuiltLibraryCopy struct {
+	prebuilt PrebuiltLibrary
+}
+
+func (cp prebuiltLibraryCopy) Build(ctx core.Context) {
+	out := cp.prebuilt.out()
+	if ctx.Built("prebuilt:" + out.Absolute()) {
+		return
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   out,
+		In:    cp.prebuilt.Lib,
+		Cmd:   fmt.Sprintf("cp %q %q", cp.prebuilt.Lib, out),
+		Descr: fmt.Sprintf("CP %s", out.Relative()),
+	})
+	if isSharedLibrary(out.Relative()) {
+		Library{Out: out, Soname: cp.prebuilt.soname()}.linkSharedNames(ctx, out)
+	}
+}
+
+func (cp prebuiltLibraryCopy) Outputs() []core.Path {
+	return []core.Path{cp.prebuilt.out()}
+}
+
+// PkgConfigLibrary is a Dep on a library installed on the system, e.g. OpenCV
+// or libusb, that is described by a pkg-config file. pkg-config is queried for
+// the compiler and linker flags whenever the build files are generated. For
+// toolchains other than the native one, it is queried in the sysroot of the
+// toolchain, which must be set (e.g. with --sysroot=).
+type PkgConfigLibrary struct {
+	// The name of the package, e.g. "opencv4".
+	Package string
+
+	// Link statically, including the private dependencies of the package.
+	Static bool
+}
+
+type pkgConfigResult struct {
+	cflags []string
+	libs   []string
+}
+
+type pkgConfigQuery struct {
+	pkg     PkgConfigLibrary
+	sysroot string
+}
+
+var pkgConfigCache = map[pkgConfigQuery]pkgConfigResult{}
+
+// pkgConfigEnv returns the environment variables that make pkg-config look for
+// packages of the toolchain's target.
+func pkgConfigEnv(toolchain Toolchain) (string, []string) {
+	sysroot := ""
+	if tcs, ok := toolchain.(interface{ sysroot() string }); ok {
+		sysroot = tcs.sysroot()
+	}
+	if sysroot == "" {
+		if ToolchainFreestanding(toolchain) || string(ToolchainArchitecture(toolchain)) != hostArchName() {
+			core.Fatal("Cannot query pkg-config for toolchain %s, as it has no sysroot", toolchain.Name())
+		}
+		return "", nil
+	}
+	libdirs := []string{
+		path.Join(sysroot, "usr/lib/pkgconfig"),
+		path.Join(sysroot, "usr/share/pkgconfig"),
+	}
+	if tct, ok := toolchain.(interface{ targetName() string }); ok && tct.targetName() != "" {
+		libdirs = append([]string{path.Join(sysroot, "usr/lib", tct.targetName(), "pkgconfig")}, libdirs...)
+	}
+	return sysroot, []string{
+		"PKG_CONFIG_SYSROOT_DIR=" + sysroot,
+		"PKG_CONFIG_LIBDIR=" + strings.Join(libdirs, ":"),
+		"PKG_CONFIG_PATH=",
+	}
+}
+
+func (pkg PkgConfigLibrary) query(toolchain Toolchain) pkgConfigResult {
+	sysroot, env := pkgConfigEnv(toolchain)
+	key := pkgConfigQuery{pkg, sysroot}
+	if result, ok := pkgConfigCache[key]; ok {
+		return result
+	}
+	run := func(args ...string) string {
+		cmd := exec.Command("pkg-config", append(args, pkg.Package)...)
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.Output()
+		if err != nil {
+			msg := ""
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				msg = strings.TrimSpace(string(exitErr.Stderr))
+			}
+			core.Fatal("'pkg-config %s %s' failed: %s %s", strings.Join(args, " "), pkg.Package, err, msg)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	libsArgs := []string{"--libs"}
+	if pkg.Static {
+		libsArgs = append(libsArgs, "--static")
+	}
+	result := pkgConfigResult{
+		cflags: strings.Fields(run("--cflags")),
+		libs:   strings.Fields(run(libsArgs...)),
+	}
+	pkgConfigCache[key] = result
+	return result
+}
+
+// CcLibrary returns a header-only library carrying the flags of the package.
+func (pkg PkgConfigLibrary) CcLibrary(toolchain Toolchain) Library {
+	toolchain = toolchainOrDefault(toolchain)
+	result := pkg.query(toolchain)
+	return Library{
+		Out:                 core.BuildPath(path.Join("pkg-config", toolchain.Name(), pkg.Package)),
+		PublicCompilerFlags: result.cflags,
+		PublicLinkerFlags:   result.libs,
+		Toolchain:           toolchain,
+	}
+}
+
+// Build a PkgConfigLibrary.
+func (pkg PkgConfigLibrary) Build(ctx core.Context) {
+	pkg.CcLibrary(DefaultToolchain()).Build(ctx)
+}
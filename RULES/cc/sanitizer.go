@@ -0,0 +1,68 @@
+package cc
+
+import (
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// Sanitizer is a combination of sanitizers (as passed to -fsanitize=).
+type Sanitizer string
+
+const (
+	SanitizerNone             Sanitizer = "none"
+	SanitizerAddress          Sanitizer = "address"
+	SanitizerUndefined        Sanitizer = "undefined"
+	SanitizerThread           Sanitizer = "thread"
+	SanitizerAddressUndefined Sanitizer = "address,undefined"
+)
+
+var sanitizerSuffixes = map[Sanitizer]string{
+	SanitizerAddress:          "asan",
+	SanitizerUndefined:        "ubsan",
+	SanitizerThread:           "tsan",
+	SanitizerAddressUndefined: "asan-ubsan",
+}
+
+var sanitizerFlag = core.StringFlag{
+	Name:        "cc-sanitizer",
+	Description: "Sanitizers to instrument C/C++ targets built with the default toolchain",
+	DefaultFn:   func() string { return string(SanitizerNone) },
+	AllowedValues: []string{
+		string(SanitizerNone),
+		string(SanitizerAddress),
+		string(SanitizerUndefined),
+		string(SanitizerThread),
+		string(SanitizerAddressUndefined),
+	},
+}.Register()
+
+func (sanitizer Sanitizer) compilerFlags() []string {
+	flags := []string{"-fsanitize=" + string(sanitizer), "-fno-omit-frame-pointer", "-g"}
+	if strings.Contains(string(sanitizer), string(SanitizerUndefined)) {
+		// Make undefined behaviour fail tests rather than just print a warning.
+		flags = append(flags, "-fno-sanitize-recover=all")
+	}
+	return flags
+}
+
+func (sanitizer Sanitizer) linkerFlags() []string {
+	return []string{"-fsanitize=" + string(sanitizer)}
+}
+
+// SanitizedToolchain derives a variant of the toolchain that instruments code
+// with the sanitizer. The variant has its own name, so its objects don't
+// collide with the uninstrumented ones, and it only accepts libraries that
+// are instrumented the same way.
+func SanitizedToolchain(toolchain Toolchain, sanitizer Sanitizer) Toolchain {
+	if sanitizer == SanitizerNone {
+		return toolchain
+	}
+	if _, ok := sanitizerSuffixes[sanitizer]; !ok {
+		core.Fatal("Unknown sanitizer %q", sanitizer)
+	}
+	if ToolchainFreestanding(toolchain) {
+		core.Fatal("Sanitizers are not supported by freestanding toolchain %s", toolchain.Name())
+	}
+	return derivedToolchain(toolchain, sanitizerSuffixes[sanitizer], sanitizer.compilerFlags(), sanitizer.linkerFlags())
+}
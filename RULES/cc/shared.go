@@ -0,0 +1,97 @@
+package cc
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// sharedLibraryToolchain is implemented by toolchains that can link shared
+// libraries with extra linker flags, e.g. to set the soname.
+type sharedLibraryToolchain interface {
+	SharedLibraryWithFlags(out core.Path, objs []core.Path, flags []string) string
+}
+
+// sharedOut returns the path of the linked shared library, which is Out unless
+// the library is versioned.
+func (lib Library) sharedOut() core.OutPath {
+	if lib.Version == "" {
+		return lib.Out
+	}
+	return lib.Out.WithSuffix("." + lib.Version)
+}
+
+func (lib Library) soname() string {
+	if lib.Soname != "" {
+		return lib.Soname
+	}
+	soname := path.Base(lib.Out.Relative())
+	if lib.Version != "" {
+		soname += "." + strings.SplitN(lib.Version, ".", 2)[0]
+	}
+	return soname
+}
+
+// buildShared links the shared library and creates its symlinks.
+func (lib Library) buildShared(ctx core.Context, toolchain Toolchain, objs []core.Path) {
+	out := lib.sharedOut()
+	// Without a soname, binaries refer to the library by the path it was
+	// linked from.
+	cmd := toolchain.SharedLibrary(out, objs)
+	if tcs, ok := toolchain.(sharedLibraryToolchain); ok {
+		cmd = tcs.SharedLibraryWithFlags(out, objs, []string{fmt.Sprintf("-Wl,-soname,%s", lib.soname())})
+	}
+	ctx.AddBuildStep(core.BuildStep{
+		Out:   out,
+		Ins:   objs,
+		Cmd:   cmd,
+		Descr: fmt.Sprintf("LD (toolchain: %s) %s", toolchain.Name(), out.Relative()),
+	})
+
+	lib.linkSharedNames(ctx, out)
+}
+
+// linkSharedNames creates the symlinks to a shared library. The soname
+// symlink is what the dynamic loader looks for, Out is what the linker uses.
+func (lib Library) linkSharedNames(ctx core.Context, out core.OutPath) {
+	var target core.OutPath = out
+	for _, name := range []string{lib.soname(), path.Base(lib.Out.Relative())} {
+		link := core.BuildPath(path.Join(path.Dir(lib.Out.Relative()), name))
+		if link.Relative() == target.Relative() || link.Relative() == out.Relative() {
+			continue
+		}
+		ctx.AddBuildStep(core.BuildStep{
+			Out:   link,
+			In:    target,
+			Cmd:   fmt.Sprintf("ln -sf %q %q", path.Base(target.Relative()), link),
+			Descr: fmt.Sprintf("LN %s", link.Relative()),
+		})
+		target = link
+	}
+}
+
+// rpathFlags returns linker flags to find the shared libraries among deps
+// relative to the binary, so it can run straight from the build directory.
+func rpathFlags(bin core.OutPath, deps []Library) []string {
+	flags := []string{}
+	seen := map[string]bool{}
+	for _, dep := range deps {
+		if !dep.Shared || dep.headerOnly() {
+			continue
+		}
+		rel, err := filepath.Rel(path.Dir(bin.Absolute()), path.Dir(dep.Out.Absolute()))
+		if err != nil {
+			core.Fatal("cannot compute rpath for %s: %s", dep.Out.Relative(), err)
+		}
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		// $$ escapes the dollar sign for ninja, the single quotes for the shell.
+		flags = append(flags, fmt.Sprintf("'-Wl,-rpath,$$ORIGIN/%s'", rel))
+	}
+	return flags
+}
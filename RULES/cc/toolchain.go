@@ -2,6 +2,7 @@ package cc
 
 import (
 	"fmt"
+	"runtime"
 	"sort"
 	"strings"
 
@@ -46,15 +47,10 @@ func ToolchainFreestanding(toolchain Toolchain) bool {
 }
 
 // ToolchainAccepts reports whether the parent toolchain accepts
-// libraries built with the child toolchain.
+// libraries built with the child toolchain: the same toolchain, toolchains it
+// is declared compatible with, or toolchains with the same attributes.
 func ToolchainAccepts(parent, child Toolchain) bool {
-	if parent.Name() == child.Name() {
-		return true
-	}
-	if tca, ok := parent.(interface{ Accepts(tc Toolchain) bool }); ok {
-		return tca.Accepts(child)
-	}
-	return false
+	return toolchainMismatch(parent, child) == ""
 }
 
 // Toolchain represents a C++ toolchain.
@@ -67,23 +63,49 @@ type GccToolchain struct {
 	Objcopy core.GlobalPath
 	Ld      core.GlobalPath
 
+	// The size tool. Defaults to size next to Objcopy.
+	Size core.GlobalPath
+
 	Includes     []core.Path
 	Deps         []Dep
 	LinkerScript core.Path
 
+	// CompilerFlags apply to sources of all languages, CFlags, CxxFlags and
+	// AsFlags only to C, C++ and assembly sources respectively.
 	CompilerFlags []string
+	CFlags        []string
+	CxxFlags      []string
+	AsFlags       []string
 	LinkerFlags   []string
 
 	ToolchainName string
 	ArchName      string
 	TargetName    string
 
+	// The version of the compiler, if known (see DetectGccToolchain).
+	// Libraries are only compatible if it matches.
+	Version string
+
 	// A list of toolchain names that libraries can be built with instead
 	// of our toolchain. (A toolchain is always compatible with
 	// itself -- there's no need to include oneself.)
 	// For example, a testing toolchain should be able to accept low-level libraries
 	// built with a non-test toolchain.
+	// Toolchains with the same attributes (see ToolchainAttributes) are
+	// compatible anyway, this overrides differences of attributes.
 	CompatibleWith []string
+
+	// The C++ standard library, if not libstdc++ or selected with -stdlib=
+	// (e.g. "libsupc++"). Libraries are only compatible if it matches.
+	CxxStdlib string
+
+	// Enables link-time optimisation. Objects are compiled and linked with
+	// -flto, and static libraries are archived with LtoAr, which indexes the
+	// symbols in LTO objects.
+	LTO bool
+
+	// The archiver for LTO objects. Defaults to gcc-ar next to Ar.
+	LtoAr core.GlobalPath
 }
 
 func (gcc GccToolchain) Accepts(tc Toolchain) bool {
@@ -115,16 +137,52 @@ func (gcc GccToolchain) Freestanding() bool {
 	return false
 }
 
+// sysroot returns the sysroot selected with --sysroot=, if any.
+func (gcc GccToolchain) sysroot() string {
+	sysroot := ""
+	for _, flag := range gcc.CompilerFlags {
+		if strings.HasPrefix(flag, "--sysroot=") {
+			sysroot = strings.Trim(strings.TrimPrefix(flag, "--sysroot="), `"`)
+		}
+	}
+	return sysroot
+}
+
+func (gcc GccToolchain) targetName() string {
+	return gcc.TargetName
+}
+
+// NewWithStdLib returns a toolchain with its own standard library. Libraries
+// built with it are only compatible with toolchains derived from it, as
+// CxxStdlib is set to the name of the new toolchain.
 func (gcc GccToolchain) NewWithStdLib(includes []core.Path, deps []Dep, linkerScript core.Path, toolchainName string) GccToolchain {
 	gcc.Includes = includes
 	gcc.Deps = deps
 	gcc.LinkerScript = linkerScript
 	gcc.ToolchainName = toolchainName
+	gcc.CxxStdlib = toolchainName
 	return gcc
 }
 
-// ObjectFile generates a compile command.
+// ObjectFile generates a compile command. C++ sources are compiled with Cxx,
+// everything else with the Cc driver, or with Cxx if Cc is not set. The
+// depfile is only written if it is not nil.
 func (gcc GccToolchain) ObjectFile(out core.OutPath, depfile core.OutPath, flags []string, includes []core.Path, src core.Path) string {
+	language := SourceLanguage(src)
+	compiler := gcc.Cc
+	if language == LanguageCxx || compiler == nil {
+		compiler = gcc.Cxx
+	}
+	if language != LanguageCxx && gcc.Cc == nil {
+		// The C++ driver compiles everything as C++, unless told otherwise.
+		flags = append([]string{"-x", string(language)}, flags...)
+	}
+	tcFlags := compilerFlags{Common: gcc.CompilerFlags, C: gcc.CFlags, Cxx: gcc.CxxFlags, As: gcc.AsFlags}
+	if gcc.LTO {
+		tcFlags.Common = append([]string{"-flto"}, tcFlags.Common...)
+	}
+	allFlags := append(tcFlags.forSource(src), flags...)
+
 	includesStr := strings.Builder{}
 	for _, include := range includes {
 		includesStr.WriteString(fmt.Sprintf("-I%q ", include))
@@ -133,12 +191,15 @@ func (gcc GccToolchain) ObjectFile(out core.OutPath, depfile core.OutPath, flags
 		includesStr.WriteString(fmt.Sprintf("-isystem %q ", include))
 	}
 
+	if depfile != nil {
+		allFlags = append([]string{"-MD", "-MF", fmt.Sprintf("%q", depfile)}, allFlags...)
+	}
+
 	return fmt.Sprintf(
-		"%q -pipe -c -o %q -MD -MF %q %s %s %q",
-		gcc.Cxx,
+		"%q -pipe -c -o %q %s %s %q",
+		compiler,
 		out,
-		depfile,
-		strings.Join(append(gcc.CompilerFlags, flags...), " "),
+		strings.Join(allFlags, " "),
 		includesStr.String(),
 		src)
 }
@@ -152,26 +213,37 @@ func (gcc GccToolchain) StaticLibrary(out core.Path, objs []core.Path) string {
 	// There is no option to ar to always force creation of a new archive; the "c"
 	// modifier simply suppresses a warning if the archive doesn't already
 	// exist. So instead we delete the target (out) if it already exists.
+	ar := gcc.Ar
+	if gcc.LTO {
+		ar = gcc.ltoAr()
+	}
 	return fmt.Sprintf(
 		"rm %q 2>/dev/null ; %q rcs %q %s",
 		out,
-		gcc.Ar,
+		ar,
 		out,
 		joinQuoted(objs))
 }
 
 // SharedLibrary generates the command to build a shared library.
 func (gcc GccToolchain) SharedLibrary(out core.Path, objs []core.Path) string {
+	return gcc.SharedLibraryWithFlags(out, objs, nil)
+}
+
+// SharedLibraryWithFlags generates the command to build a shared library with
+// extra linker flags.
+func (gcc GccToolchain) SharedLibraryWithFlags(out core.Path, objs []core.Path, flags []string) string {
 	return fmt.Sprintf(
-		"%q -pipe -shared -o %q %s",
+		"%q -pipe -shared -o %q %s %s",
 		gcc.Cxx,
 		out,
-		joinQuoted(objs))
+		joinQuoted(objs),
+		strings.Join(append(gcc.linkerFlags(), flags...), " "))
 }
 
 // Binary generates the command to build an executable.
 func (gcc GccToolchain) Binary(out core.Path, objs []core.Path, alwaysLinkLibs []core.Path, libs []core.Path, flags []string, script core.Path) string {
-	flags = append(gcc.LinkerFlags, flags...)
+	flags = append(gcc.linkerFlags(), flags...)
 	if script != nil {
 		flags = append(flags, "-T", fmt.Sprintf("%q", script))
 	} else if gcc.LinkerScript != nil {
@@ -188,6 +260,25 @@ func (gcc GccToolchain) Binary(out core.Path, objs []core.Path, alwaysLinkLibs [
 		strings.Join(flags, " "))
 }
 
+func (gcc GccToolchain) linkerFlags() []string {
+	flags := append([]string{}, gcc.LinkerFlags...)
+	if gcc.LTO {
+		flags = append(flags, "-flto")
+	}
+	return flags
+}
+
+func (gcc GccToolchain) ltoAr() core.GlobalPath {
+	if gcc.LtoAr != nil {
+		return gcc.LtoAr
+	}
+	ar := gcc.Ar.Absolute()
+	if !strings.HasSuffix(ar, "ar") {
+		core.Fatal("Cannot derive the LTO archiver of toolchain %s from %q, set LtoAr", gcc.Name(), ar)
+	}
+	return core.NewGlobalPath(strings.TrimSuffix(ar, "ar") + "gcc-ar")
+}
+
 // BlobObject creates an object file from any binary blob of data
 func (gcc GccToolchain) BlobObject(out core.OutPath, src core.Path) string {
 	return fmt.Sprintf(
@@ -217,6 +308,38 @@ func (gcc GccToolchain) Name() string {
 	return gcc.ToolchainName
 }
 
+// derivedToolchain returns a variant of a gcc or clang toolchain with extra
+// compiler and linker flags, named after the original with the suffix. Beyond
+// toolchains of the same attributes, the variant only accepts libraries built
+// with the same variant of the toolchains the original is compatible with.
+func derivedToolchain(toolchain Toolchain, suffix string, compilerFlags []string, linkerFlags []string) Toolchain {
+	compatibleWith := func(names []string) []string {
+		result := []string{}
+		for _, name := range names {
+			result = append(result, name+"-"+suffix)
+		}
+		return result
+	}
+
+	switch tc := toolchain.(type) {
+	case GccToolchain:
+		tc.CompilerFlags = append(append([]string{}, tc.CompilerFlags...), compilerFlags...)
+		tc.LinkerFlags = append(append([]string{}, tc.LinkerFlags...), linkerFlags...)
+		tc.ToolchainName = tc.ToolchainName + "-" + suffix
+		tc.CompatibleWith = compatibleWith(tc.CompatibleWith)
+		return tc
+	case ClangToolchain:
+		tc.CompilerFlags = append(append([]string{}, tc.CompilerFlags...), compilerFlags...)
+		tc.LinkerFlags = append(append([]string{}, tc.LinkerFlags...), linkerFlags...)
+		tc.ToolchainName = tc.ToolchainName + "-" + suffix
+		tc.CompatibleWith = compatibleWith(tc.CompatibleWith)
+		return tc
+	}
+
+	core.Fatal("Cannot derive a %s variant of toolchain %s", suffix, toolchain.Name())
+	return nil
+}
+
 func joinQuoted(paths []core.Path) string {
 	b := strings.Builder{}
 	for _, p := range paths {
@@ -235,6 +358,27 @@ func RegisterToolchain(toolchain Toolchain) Toolchain {
 	return toolchain
 }
 
+// registerToolchainAlias makes a registered toolchain available under another
+// name as well.
+func registerToolchainAlias(alias string, toolchain Toolchain) {
+	if _, found := toolchains[alias]; found {
+		core.Fatal("A toolchain with name %s has already been registered", alias)
+	}
+	toolchains[alias] = toolchain
+}
+
+// hostArchName returns the name of the architecture of the build host, in the
+// form used by compilers.
+func hostArchName() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+	return runtime.GOARCH
+}
+
 var NativeGcc = RegisterToolchain(GccToolchain{
 	Ar:      core.NewGlobalPath("ar"),
 	As:      core.NewGlobalPath("as"),
@@ -248,7 +392,7 @@ var NativeGcc = RegisterToolchain(GccToolchain{
 	LinkerFlags:   []string{"-fdiagnostics-color=always"},
 
 	ToolchainName: "native-gcc",
-	ArchName:      "x86_64", // TODO: don't hardcode this.
+	ArchName:      hostArchName(),
 })
 
 var defaultToolchainFlag = core.StringFlag{
@@ -257,10 +401,14 @@ var defaultToolchainFlag = core.StringFlag{
 	DefaultFn:   func() string { return NativeGcc.Name() },
 }.Register()
 
-// DefaultToolchain returns the default toolchain: either the native gcc
-// toolchain, or the toolchain specified on the command-line with the cc-toolchain flag.
-func DefaultToolchain() Toolchain {
-	if toolchain, ok := toolchains[defaultToolchainFlag.Value()]; ok {
+var hostToolchainFlag = core.StringFlag{
+	Name:        "cc-host-toolchain",
+	Description: "Toolchain to compile C/C++ tools that are executed on the build host",
+	DefaultFn:   func() string { return NativeGcc.Name() },
+}.Register()
+
+func registeredToolchain(name string) Toolchain {
+	if toolchain, ok := toolchains[name]; ok {
 		return toolchain
 	}
 	var all []string
@@ -268,10 +416,52 @@ func DefaultToolchain() Toolchain {
 		all = append(all, fmt.Sprintf("%q", tc))
 	}
 	sort.Strings(all)
-	core.Fatal("No registered toolchain %q. Registered toolchains: %s", defaultToolchainFlag.Value(), strings.Join(all, ", "))
+	core.Fatal("No registered toolchain %q. Registered toolchains: %s", name, strings.Join(all, ", "))
 	return nil
 }
 
+// DefaultToolchain returns the default toolchain: either the native gcc
+// toolchain, or the toolchain specified on the command-line with the cc-toolchain flag.
+// If the cc-sanitizer, cc-coverage or cc-lto flags are set, the corresponding
+// variant of that toolchain is returned.
+func DefaultToolchain() Toolchain {
+	toolchain := registeredToolchain(defaultToolchainFlag.Value())
+	toolchain = SanitizedToolchain(toolchain, Sanitizer(sanitizerFlag.Value()))
+	if coverageFlag.Value() {
+		toolchain = CoverageToolchain(toolchain)
+	}
+	if ltoFlag.Value() {
+		toolchain = LTOToolchain(toolchain)
+	}
+	return toolchain
+}
+
+var ltoFlag = core.BoolFlag{
+	Name:        "cc-lto",
+	Description: "Enable link-time optimisation for C/C++ targets built with the default toolchain",
+	DefaultFn:   func() bool { return false },
+}.Register()
+
+// LTOToolchain derives a variant of the toolchain with link-time optimisation.
+func LTOToolchain(toolchain Toolchain) Toolchain {
+	switch tc := toolchain.(type) {
+	case GccToolchain:
+		tc.LTO = true
+		toolchain = tc
+	case ClangToolchain:
+		tc.LTO = true
+		toolchain = tc
+	}
+	return derivedToolchain(toolchain, "lto", nil, nil)
+}
+
+// HostToolchain returns the toolchain for tools that run on the build host:
+// either the native gcc toolchain, or the toolchain specified on the
+// command-line with the cc-host-toolchain flag.
+func HostToolchain() Toolchain {
+	return registeredToolchain(hostToolchainFlag.Value())
+}
+
 func toolchainOrDefault(toolchain Toolchain) Toolchain {
 	if toolchain == nil {
 		return DefaultToolchain()
@@ -0,0 +1,248 @@
+package cc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"dbt-rules/RULES/core"
+)
+
+// toolchainSpec is the description of a toolchain in a toolchain file.
+type toolchainSpec struct {
+	Name string `json:"name"`
+
+	// "gcc" (the default) or "clang".
+	Type string `json:"type"`
+
+	// Prefix of the tool paths, e.g. "/opt/gcc-arm/bin/arm-none-eabi-". The
+	// tools are named as usual for the type of toolchain after the prefix,
+	// unless set explicitly.
+	Prefix string `json:"prefix"`
+
+	Ar      string `json:"ar"`
+	As      string `json:"as"`
+	Cc      string `json:"cc"`
+	Cxx     string `json:"cxx"`
+	Objcopy string `json:"objcopy"`
+	Ld      string `json:"ld"`
+	Size    string `json:"size"`
+
+	// gcc only: the architecture, e.g. "aarch64", and the target triple.
+	Arch   string `json:"arch"`
+	Target string `json:"target"`
+
+	// clang only.
+	Sysroot string `json:"sysroot"`
+
+	// Relative to the directory of the toolchain file.
+	Includes     []string `json:"includes"`
+	LinkerScript string   `json:"linkerScript"`
+
+	CompilerFlags []string `json:"compilerFlags"`
+	CFlags        []string `json:"cFlags"`
+	CxxFlags      []string `json:"cxxFlags"`
+	AsFlags       []string `json:"asFlags"`
+	LinkerFlags   []string `json:"linkerFlags"`
+
+	CompatibleWith []string `json:"compatibleWith"`
+	CxxStdlib      string   `json:"cxxStdlib"`
+	LTO            bool     `json:"lto"`
+}
+
+var defaultToolNames = map[string]map[string]string{
+	"gcc": {
+		"ar": "ar", "as": "as", "cc": "gcc", "cxx": "g++",
+		"objcopy": "objcopy", "ld": "ld", "size": "size",
+	},
+	"clang": {
+		"ar": "llvm-ar", "cc": "clang", "cxx": "clang++",
+		"objcopy": "llvm-objcopy", "ld": "ld.lld", "size": "llvm-size",
+	},
+}
+
+// LoadToolchains registers the toolchains described in a JSON toolchain file,
+// and returns them. The file contains an object with a "toolchains" list, e.g.:
+//
+//	{
+//	  "toolchains": [
+//	    {
+//	      "name": "arm-none-eabi",
+//	      "prefix": "/opt/gcc-arm/bin/arm-none-eabi-",
+//	      "arch": "arm",
+//	      "includes": ["include"],
+//	      "linkerScript": "board.ld",
+//	      "compilerFlags": ["-mcpu=cortex-m4", "-ffreestanding"],
+//	      "linkerFlags": ["-mcpu=cortex-m4", "-ffreestanding", "-nostdlib"]
+//	    }
+//	  ]
+//	}
+//
+// The fields correspond to those of GccToolchain and ClangToolchain. Standard
+// library deps can't be declared in the file.
+func LoadToolchains(file core.Path) []Toolchain {
+	data, err := ioutil.ReadFile(file.Absolute())
+	if err != nil {
+		core.Fatal("Cannot read toolchain file: %s", err)
+		return nil
+	}
+
+	var content struct {
+		Toolchains []json.RawMessage `json:"toolchains"`
+	}
+	if err := strictUnmarshal(data, &content); err != nil {
+		core.Fatal("%s: %s", file.Relative(), err)
+		return nil
+	}
+
+	result := []Toolchain{}
+	for i, raw := range content.Toolchains {
+		fail := func(format string, a ...interface{}) {
+			core.Fatal("%s: toolchains[%d]: %s", file.Relative(), i, fmt.Sprintf(format, a...))
+		}
+		var spec toolchainSpec
+		if err := strictUnmarshal(raw, &spec); err != nil {
+			fail("%s", err)
+			continue
+		}
+		if toolchain := spec.toolchain(path.Dir(file.Relative()), fail); toolchain != nil {
+			result = append(result, RegisterToolchain(toolchain))
+		}
+	}
+	return result
+}
+
+// strictUnmarshal decodes JSON, rejecting unknown fields so that typos don't
+// go unnoticed.
+func strictUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field != "" {
+			return fmt.Errorf("field %q: cannot use %s as %s", typeErr.Field, typeErr.Value, typeErr.Type)
+		}
+		return err
+	}
+	return nil
+}
+
+func (spec toolchainSpec) toolchain(dir string, fail func(format string, a ...interface{})) Toolchain {
+	if spec.Name == "" {
+		fail("field \"name\" is required")
+		return nil
+	}
+	if spec.Type == "" {
+		spec.Type = "gcc"
+	}
+	toolNames, ok := defaultToolNames[spec.Type]
+	if !ok {
+		fail("field \"type\" of toolchain %s: must be \"gcc\" or \"clang\", not %q", spec.Name, spec.Type)
+		return nil
+	}
+
+	valid := true
+	tool := func(field string, value string) core.GlobalPath {
+		if value == "" {
+			if toolNames[field] == "" {
+				return nil
+			}
+			value = spec.Prefix + toolNames[field]
+		}
+		if strings.ContainsAny(value, " \t") {
+			fail("field %q of toolchain %s: tool paths can't contain spaces, use the flag fields", field, spec.Name)
+			valid = false
+		}
+		return core.NewGlobalPath(value)
+	}
+	source := func(field string, value string) core.Path {
+		if path.IsAbs(value) {
+			fail("field %q of toolchain %s: %q must be relative to the toolchain file", field, spec.Name, value)
+			valid = false
+		}
+		return core.SourcePath(path.Join(dir, value))
+	}
+	onlyFor := func(typ string, field string, value string) {
+		if value != "" && spec.Type != typ {
+			fail("field %q of toolchain %s: only supported by %s toolchains", field, spec.Name, typ)
+			valid = false
+		}
+	}
+
+	includes := []core.Path{}
+	for _, include := range spec.Includes {
+		includes = append(includes, source("includes", include))
+	}
+	var linkerScript core.Path
+	if spec.LinkerScript != "" {
+		linkerScript = source("linkerScript", spec.LinkerScript)
+	}
+	onlyFor("gcc", "as", spec.As)
+	onlyFor("gcc", "arch", spec.Arch)
+	onlyFor("clang", "sysroot", spec.Sysroot)
+
+	cc := tool("cc", spec.Cc)
+
+	var toolchain Toolchain
+	switch spec.Type {
+	case "gcc":
+		toolchain = GccToolchain{
+			Ar:      tool("ar", spec.Ar),
+			As:      tool("as", spec.As),
+			Cc:      cc,
+			Cpp:     core.NewGlobalPath(cc.Absolute() + " -E"),
+			Cxx:     tool("cxx", spec.Cxx),
+			Objcopy: tool("objcopy", spec.Objcopy),
+			Ld:      tool("ld", spec.Ld),
+			Size:    tool("size", spec.Size),
+
+			Includes:     includes,
+			LinkerScript: linkerScript,
+
+			CompilerFlags: spec.CompilerFlags,
+			CFlags:        spec.CFlags,
+			CxxFlags:      spec.CxxFlags,
+			AsFlags:       spec.AsFlags,
+			LinkerFlags:   spec.LinkerFlags,
+
+			ToolchainName:  spec.Name,
+			ArchName:       spec.Arch,
+			TargetName:     spec.Target,
+			CompatibleWith: spec.CompatibleWith,
+			CxxStdlib:      spec.CxxStdlib,
+			LTO:            spec.LTO,
+		}
+	case "clang":
+		toolchain = ClangToolchain{
+			Cc:      cc,
+			Cxx:     tool("cxx", spec.Cxx),
+			Ar:      tool("ar", spec.Ar),
+			Objcopy: tool("objcopy", spec.Objcopy),
+			Ld:      tool("ld", spec.Ld),
+			Size:    tool("size", spec.Size),
+
+			Target:  spec.Target,
+			Sysroot: spec.Sysroot,
+
+			Includes:     includes,
+			LinkerScript: linkerScript,
+
+			CompilerFlags: spec.CompilerFlags,
+			CFlags:        spec.CFlags,
+			CxxFlags:      spec.CxxFlags,
+			AsFlags:       spec.AsFlags,
+			LinkerFlags:   spec.LinkerFlags,
+
+			ToolchainName:  spec.Name,
+			CompatibleWith: spec.CompatibleWith,
+			CxxStdlib:      spec.CxxStdlib,
+			LTO:            spec.LTO,
+		}
+	}
+	if !valid {
+		return nil
+	}
+	return toolchain
+}
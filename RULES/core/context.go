@@ -1,6 +1,7 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"hash/crc32"
 	"io/ioutil"
@@ -22,6 +23,8 @@ type Context interface {
 	// It can be used to build a target at most once:
 	//   if ctx.Built(out) { return }
 	//   ... actually build out
+	// If the id is the absolute path of an output built for another target,
+	// the outputs of its build step also become outputs of the current target.
 	Built(id string) bool
 
 	// WithTrace calls the given function, with the given value added
@@ -36,11 +39,14 @@ type Context interface {
 
 // BuildStep represents one build step (i.e., one build command).
 // Each BuildStep produces `Out` and `Outs` from `Ins` and `In` by running `Cmd`.
+// `OrderOnly` inputs must exist before the step runs, but changes to them do
+// not cause the step to rerun (the depfile tracks the ones actually used).
 type BuildStep struct {
 	Out          OutPath
 	Outs         []OutPath
 	In           Path
 	Ins          []Path
+	OrderOnly    []Path
 	Depfile      OutPath
 	Cmd          string
 	Script       string
@@ -83,10 +89,21 @@ type testInterface interface {
 	Test(args []string) string
 }
 
+// outputInfo describes how an output is produced, for the output index.
+type outputInfo struct {
+	Target    string
+	Trace     []string
+	Cmd       string
+	Ins       []string
+	OrderOnly []string
+	Depfile   string
+}
+
 type context struct {
 	cwd                OutPath
 	targetDependencies []string
 	leafOutputs        map[Path]bool
+	outputIndex        map[string]outputInfo
 
 	targetNames  map[interface{}]string
 	buildOutputs map[string]BuildStep
@@ -102,6 +119,7 @@ func newContext(vars map[string]interface{}) *context {
 	ctx := &context{
 		cwd:         outPath{""},
 		leafOutputs: map[Path]bool{},
+		outputIndex: map[string]outputInfo{},
 
 		targetNames:  map[interface{}]string{},
 		buildOutputs: map[string]BuildStep{},
@@ -121,6 +139,11 @@ func newContext(vars map[string]interface{}) *context {
 
 func (ctx *context) Built(id string) bool {
 	if ctx.seenOnce[id] {
+		if step, ok := ctx.buildOutputs[id]; ok && ctx.outputIndex[id].Target != currentTarget {
+			for _, out := range step.outs() {
+				ctx.leafOutputs[out] = true
+			}
+		}
 		return true
 	}
 	ctx.seenOnce[id] = true
@@ -154,10 +177,20 @@ func (ctx *context) AddBuildStep(step BuildStep) {
 	}
 
 	ins := []string{}
+	info := outputInfo{Target: currentTarget, Trace: ctx.Trace()}
 	for _, in := range step.ins() {
 		ins = append(ins, ninjaEscape(in.Absolute()))
+		info.Ins = append(info.Ins, in.Absolute())
 		delete(ctx.leafOutputs, in)
 	}
+	if len(step.OrderOnly) > 0 {
+		ins = append(ins, "||")
+		for _, in := range step.OrderOnly {
+			ins = append(ins, ninjaEscape(in.Absolute()))
+			info.OrderOnly = append(info.OrderOnly, in.Absolute())
+			delete(ctx.leafOutputs, in)
+		}
+	}
 
 	data := ""
 	dataFileMode := os.FileMode(0644)
@@ -201,6 +234,14 @@ func (ctx *context) AddBuildStep(step BuildStep) {
 		step.Cmd = fmt.Sprintf("cp %q %q", dataFilePath, step.Out)
 	}
 
+	info.Cmd = step.Cmd
+	if step.Depfile != nil {
+		info.Depfile = step.Depfile.Absolute()
+	}
+	for _, out := range step.outs() {
+		ctx.outputIndex[out.Absolute()] = info
+	}
+
 	fmt.Fprintf(&ctx.ninjaFile, "# trace: %s\n", strings.Join(ctx.Trace(), " // "))
 	fmt.Fprintf(&ctx.ninjaFile, "rule r%d\n", ctx.nextRuleID)
 	if step.Depfile != nil {
@@ -306,6 +347,26 @@ func (ctx *context) addTargetDependency(target interface{}) {
 	ctx.targetDependencies = append(ctx.targetDependencies, name)
 }
 
+// writeOutputIndex writes the output index, which maps every output in the
+// build directory to the target, trace, command and direct inputs that
+// produced it.
+func (ctx *context) writeOutputIndex() {
+	data, err := json.MarshalIndent(ctx.outputIndex, "", "  ")
+	if err != nil {
+		Fatal("failed to marshal output index: %s", err)
+	}
+	if err := os.MkdirAll(buildDir(), os.ModePerm); err != nil {
+		Fatal("failed to create build directory: %s", err)
+	}
+	if err := ioutil.WriteFile(outputIndexPath(), data, 0644); err != nil {
+		Fatal("failed to write output index: %s", err)
+	}
+}
+
+func outputIndexPath() string {
+	return path.Join(buildDir(), outputIndexFileName)
+}
+
 func ninjaEscape(s string) string {
 	return strings.ReplaceAll(s, " ", "$ ")
 }
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+var explainOutputScript = `#!/usr/bin/env python3
+import json
+import os
+import sys
+
+index_file, build_dir = sys.argv[1:3]
+queries = sys.argv[3:]
+if not queries:
+    sys.exit("usage: <output>... (absolute, relative to the build directory, or a path suffix)")
+
+with open(index_file) as f:
+    index = json.load(f)
+
+
+def find(query):
+    for candidate in (query, os.path.abspath(query), os.path.join(build_dir, query)):
+        if candidate in index:
+            return [candidate]
+    return sorted(out for out in index if out.endswith("/" + query.lstrip("/")))
+
+
+def mtime(path):
+    try:
+        return os.stat(path).st_mtime
+    except OSError:
+        return None
+
+
+def read_depfile(path):
+    """Returns the inputs listed in a Makefile-style depfile, or None."""
+    try:
+        with open(path) as f:
+            content = f.read()
+    except OSError:
+        return None
+    deps = []
+    for rule in content.replace("\\\n", " ").splitlines():
+        if ":" not in rule:
+            continue
+        word = ""
+        escaped = False
+        for c in rule.split(":", 1)[1] + " ":
+            if escaped:
+                word += c
+                escaped = False
+            elif c == "\\":
+                escaped = True
+            elif c.isspace():
+                if word and word not in deps:
+                    deps.append(word)
+                word = ""
+            else:
+                word += c
+    return deps
+
+
+def print_inputs(paths, out_mtime):
+    for path in paths:
+        in_mtime = mtime(path)
+        if in_mtime is None:
+            status = "missing"
+        elif out_mtime is not None and in_mtime > out_mtime:
+            status = "newer than output"
+        else:
+            status = ""
+        print("  %-18s %s" % (status, path))
+
+
+for query in queries:
+    matches = find(query)
+    if not matches:
+        print("%s: not produced by any build step\n" % query)
+        continue
+    for out in matches:
+        info = index[out]
+        out_mtime = mtime(out)
+        print("Output:  %s" % out)
+        if out_mtime is None:
+            print("Status:  missing, will be built")
+        print("Target:  %s" % (info["Target"] or "<none>"))
+        print("Trace:")
+        for i, entry in enumerate(info["Trace"] or []):
+            print("  %s%s" % ("  " * i, entry))
+        print("Command:")
+        print("  %s" % info["Cmd"])
+        print("Inputs:")
+        print_inputs(info["Ins"] or [], out_mtime)
+        if info.get("Depfile"):
+            deps = read_depfile(info["Depfile"])
+            if deps is None:
+                print("Inputs from depfile: not known until built")
+            else:
+                # Relative paths are relative to where ninja runs.
+                deps = [os.path.join(os.path.dirname(build_dir), d) for d in deps]
+                declared = set(info["Ins"] or [])
+                print("Inputs from depfile (e.g. headers):")
+                print_inputs([d for d in deps if d not in declared], out_mtime)
+        if info.get("OrderOnly"):
+            # Order-only inputs are built first, but their changes don't
+            # rebuild the output unless the depfile lists them.
+            print("Order-only inputs:")
+            for path in info["OrderOnly"]:
+                print("  %-18s %s" % ("missing" if mtime(path) is None else "", path))
+        print("")
+`
+
+// ExplainOutput explains why and how outputs are built. Running it with paths
+// of outputs as arguments prints, for each output, the target and trace that
+// produced it, its command, its direct inputs and the inputs discovered in its
+// depfile (e.g. headers), marking those that are newer than the output, and its
+// order-only inputs. Paths can be absolute, relative to the build
+// directory, or any unique suffix.
+type ExplainOutput struct {
+	Out OutPath
+}
+
+// Build for ExplainOutput.
+func (explain ExplainOutput) Build(ctx Context) {
+	ctx.AddBuildStep(BuildStep{
+		Out:          explain.Out,
+		Data:         explainOutputScript,
+		DataFileMode: 0755,
+	})
+}
+
+// Run for ExplainOutput.
+func (explain ExplainOutput) Run(args []string) string {
+	quotedArgs := []string{}
+	for _, arg := range args {
+		quotedArgs = append(quotedArgs, fmt.Sprintf("%q", arg))
+	}
+	return fmt.Sprintf("%q %q %q %s", explain.Out, outputIndexPath(), buildDir(), strings.Join(quotedArgs, " "))
+}
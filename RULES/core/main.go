@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"path"
+	"sort"
 	"unicode"
 )
 
 const buildProtocolVersion = 2
 const inputFileName = "input.json"
 const outputFileName = "output.json"
+const outputIndexFileName = "output_index.json"
 
 type targetInfo struct {
 	Description string
@@ -69,13 +71,22 @@ func GeneratorMain(vars map[string]interface{}) {
 
 	// Create build files.
 	if !input.CompletionsOnly {
+		// Targets are handled in a fixed order, so that outputs shared by
+		// several targets are always attributed to the same one.
+		targetPaths := []string{}
+		for targetPath := range vars {
+			targetPaths = append(targetPaths, targetPath)
+		}
+		sort.Strings(targetPaths)
+
 		ctx := newContext(vars)
-		for targetPath, variable := range vars {
-			if build, ok := variable.(buildInterface); ok {
+		for _, targetPath := range targetPaths {
+			if build, ok := vars[targetPath].(buildInterface); ok {
 				ctx.handleTarget(targetPath, build)
 			}
 		}
 		output.NinjaFile = ctx.ninjaFile.String()
+		ctx.writeOutputIndex()
 	}
 
 	// Serialize generator output.
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+var buildProfileScript = `#!/usr/bin/env python3
+import collections
+import json
+import sys
+
+index_file, ninja_log, trace_file, summary_file = sys.argv[1:5]
+
+with open(index_file) as f:
+    index = json.load(f)
+
+# Ninja logs one line per output. Outputs of the same edge share the start
+# time, end time and command hash. Later lines supersede earlier ones.
+edges = {}
+with open(ninja_log) as f:
+    header = f.readline()
+    if not header.startswith("# ninja log v"):
+        sys.exit("%s is not a ninja log" % ninja_log)
+    for line in f:
+        fields = line.rstrip("\n").split("\t")
+        if len(fields) < 5:
+            continue
+        start, end, _, output, cmdhash = fields[:5]
+        edges[output] = (int(start), int(end), cmdhash)
+
+steps = collections.OrderedDict()
+for output, (start, end, cmdhash) in sorted(edges.items(), key=lambda e: e[1]):
+    step = steps.setdefault((start, end, cmdhash), {"start": start, "end": end, "outputs": []})
+    step["outputs"].append(output)
+
+targets = collections.defaultdict(lambda: {"time": 0, "steps": 0})
+events = []
+lanes = []
+for step in steps.values():
+    info = None
+    for output in step["outputs"]:
+        if output in index:
+            info = index[output]
+            break
+    if info is None:
+        info = {"Target": "<unknown>", "Trace": []}
+    target = info["Target"] or "<unknown>"
+    duration = step["end"] - step["start"]
+    targets[target]["time"] += duration
+    targets[target]["steps"] += 1
+
+    # Assign each step to the first lane that is free, so that concurrent
+    # steps show up as parallel threads.
+    for lane, busy_until in enumerate(lanes):
+        if busy_until <= step["start"]:
+            lanes[lane] = step["end"]
+            break
+    else:
+        lane = len(lanes)
+        lanes.append(step["end"])
+
+    events.append({
+        "name": step["outputs"][0],
+        "cat": target,
+        "ph": "X",
+        "ts": step["start"] * 1000,
+        "dur": duration * 1000,
+        "pid": 0,
+        "tid": lane,
+        "args": {"target": target, "trace": info["Trace"], "outputs": step["outputs"]},
+    })
+
+with open(trace_file, "w") as f:
+    json.dump({"traceEvents": events, "displayTimeUnit": "ms"}, f)
+
+total = sum(t["time"] for t in targets.values()) or 1
+lines = ["%10s %6s %6s  %s" % ("TIME (s)", "%", "STEPS", "TARGET")]
+for target, t in sorted(targets.items(), key=lambda t: -t[1]["time"]):
+    lines.append("%10.2f %6.1f %6d  %s" % (t["time"] / 1000.0, 100.0 * t["time"] / total, t["steps"], target))
+with open(summary_file, "w") as f:
+    f.write("\n".join(lines) + "\n")
+
+print("\n".join(lines))
+print("\nChrome trace written to %s (open in chrome://tracing or ui.perfetto.dev)" % trace_file)
+`
+
+// BuildProfile reports the time spent building each target. Running it joins
+// the ninja log of previous builds with the output index written by the
+// generator, prints a per-target timing summary, and writes a trace in the
+// Chrome trace-event format.
+//
+// The first run argument, if given, overrides the path of the ninja log.
+type BuildProfile struct {
+	// Path to the Chrome trace-event JSON file.
+	Out OutPath
+}
+
+func (profile BuildProfile) script() OutPath {
+	return profile.Out.WithExt("py")
+}
+
+func (profile BuildProfile) summary() OutPath {
+	return profile.Out.WithExt("txt")
+}
+
+// Build for BuildProfile.
+func (profile BuildProfile) Build(ctx Context) {
+	ctx.AddBuildStep(BuildStep{
+		Out:          profile.script(),
+		Data:         buildProfileScript,
+		DataFileMode: 0755,
+	})
+}
+
+// Run for BuildProfile.
+func (profile BuildProfile) Run(args []string) string {
+	ninjaLog := path.Join(filepath.Dir(buildDir()), ".ninja_log")
+	if len(args) > 0 {
+		ninjaLog = args[0]
+	}
+	return fmt.Sprintf("%q %q %q %q %q", profile.script(), outputIndexPath(), ninjaLog, profile.Out, profile.summary())
+}
@@ -12,16 +12,55 @@ import (
 	"strings"
 )
 
+// GeneratedSources is implemented by targets generating Go sources. Each
+// generated file is overlaid onto the source tree at the same relative path
+// (see -overlay in `go help build`), so packages can import it as if it had
+// been checked in.
+type GeneratedSources interface {
+	Build(ctx core.Context)
+	GoSources() []core.OutPath
+}
+
 type Binary struct {
-	Out     core.OutPath
-	Package core.Path
+	Out       core.OutPath
+	Package   core.Path
+	Generated []GeneratedSources
+}
+
+type overlay struct {
+	Replace map[string]string
 }
 
 func (bin Binary) Build(ctx core.Context) {
+	ins := bin.getInputs()
+	cmd := fmt.Sprintf("cd %q && go build -o %q", bin.Package, bin.Out)
+
+	if len(bin.Generated) > 0 {
+		ovl := overlay{Replace: map[string]string{}}
+		for _, gen := range bin.Generated {
+			gen.Build(ctx)
+			for _, src := range gen.GoSources() {
+				ovl.Replace[core.SourcePath(src.Relative()).Absolute()] = src.Absolute()
+				ins = append(ins, src)
+			}
+		}
+		data, err := json.MarshalIndent(ovl, "", "  ")
+		if err != nil {
+			core.Fatal("failed to marshal go overlay: %s", err)
+		}
+		overlayFile := bin.Out.WithSuffix(".overlay.json")
+		ctx.AddBuildStep(core.BuildStep{
+			Out:  overlayFile,
+			Data: string(data),
+		})
+		ins = append(ins, overlayFile)
+		cmd = fmt.Sprintf("%s -overlay %q", cmd, overlayFile)
+	}
+
 	ctx.AddBuildStep(core.BuildStep{
 		Out: bin.Out,
-		Ins: bin.getInputs(),
-		Cmd: fmt.Sprintf("cd %q && go build -o %q", bin.Package, bin.Out),
+		Ins: ins,
+		Cmd: cmd,
 	})
 }
 
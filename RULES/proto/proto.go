@@ -0,0 +1,177 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+
+	"dbt-rules/RULES/cc"
+	"dbt-rules/RULES/core"
+)
+
+var protocFlag = core.StringFlag{
+	Name:        "proto-protoc",
+	Description: "Path to the protoc compiler, used by proto libraries that don't build their own",
+	DefaultFn:   func() string { return "protoc" },
+}.Register()
+
+// Tool is an executable that is built from source before being run by a build
+// step, e.g. a cc.HostBinary.
+type Tool interface {
+	Build(ctx core.Context)
+	Out() core.OutPath
+}
+
+// Library compiles .proto files to C++ and Go sources.
+//
+// Proto files import each other by their path relative to the workspace root.
+// The generated files mirror that path in the build directory, so the C++ code
+// for "foo/bar.proto" is included as "foo/bar.pb.h".
+type Library struct {
+	// Static C++ library for the generated C++ code.
+	Out core.OutPath
+
+	Srcs []core.Path
+	Deps []Library
+
+	// The protocol buffer compiler. If nil, the proto-protoc flag is used.
+	Protoc Tool
+
+	// The protobuf runtime library the generated C++ code links against.
+	CcRuntime cc.Dep
+
+	// The protoc-gen-go plugin. If nil, protoc searches for it in PATH.
+	GoPlugin Tool
+}
+
+func (lib Library) transitiveSrcs() []core.Path {
+	srcs := append([]core.Path{}, lib.Srcs...)
+	for _, dep := range lib.Deps {
+		srcs = append(srcs, dep.transitiveSrcs()...)
+	}
+	return srcs
+}
+
+func (lib Library) outs(ext string) []core.OutPath {
+	outs := []core.OutPath{}
+	for _, src := range lib.Srcs {
+		outs = append(outs, src.WithExt(ext))
+	}
+	return outs
+}
+
+func toPaths(outs []core.OutPath) []core.Path {
+	paths := []core.Path{}
+	for _, out := range outs {
+		paths = append(paths, out)
+	}
+	return paths
+}
+
+func (lib Library) generate(ctx core.Context, lang string, outs []core.OutPath, flags []string, tools []Tool) {
+	if len(outs) == 0 || ctx.Built(outs[0].Absolute()) {
+		return
+	}
+
+	ins := lib.transitiveSrcs()
+	protoc := protocFlag.Value()
+	if lib.Protoc != nil {
+		lib.Protoc.Build(ctx)
+		ins = append(ins, lib.Protoc.Out())
+		protoc = lib.Protoc.Out().Absolute()
+	}
+	for _, tool := range tools {
+		tool.Build(ctx)
+		ins = append(ins, tool.Out())
+	}
+
+	srcs := []string{}
+	for _, src := range lib.Srcs {
+		srcs = append(srcs, fmt.Sprintf("%q", src))
+	}
+
+	ctx.AddBuildStep(core.BuildStep{
+		Outs: outs,
+		Ins:  ins,
+		Cmd: fmt.Sprintf("%q -I%q %s %s",
+			protoc,
+			core.SourcePath(""),
+			strings.Join(flags, " "),
+			strings.Join(srcs, " ")),
+		Descr: fmt.Sprintf("PROTOC (%s) %s", lang, outs[0].Relative()),
+	})
+}
+
+type ccSources Library
+
+// Build generates the C++ sources and headers.
+func (srcs ccSources) Build(ctx core.Context) {
+	lib := Library(srcs)
+	outs := append(lib.outs("pb.cc"), lib.outs("pb.h")...)
+	flags := []string{fmt.Sprintf("--cpp_out=%q", core.BuildPath(""))}
+	lib.generate(ctx, "C++", outs, flags, nil)
+}
+
+// CcLibrary returns the library of the generated C++ code for the toolchain.
+func (lib Library) CcLibrary(toolchain cc.Toolchain) cc.Library {
+	if lib.Out == nil {
+		core.Fatal("Out field is required for proto.Library")
+	}
+
+	deps := []cc.Dep{}
+	for _, dep := range lib.Deps {
+		deps = append(deps, dep)
+	}
+	if lib.CcRuntime != nil {
+		deps = append(deps, lib.CcRuntime)
+	}
+
+	return cc.Library{
+		Out:        lib.Out,
+		Srcs:       toPaths(lib.outs("pb.cc")),
+		Hdrs:       toPaths(lib.outs("pb.h")),
+		Includes:   []core.Path{core.BuildPath("")},
+		Deps:       deps,
+		Generators: []cc.Generator{ccSources(lib)},
+	}.MultipleToolchains().CcLibrary(toolchain)
+}
+
+// Build the C++ library with the default toolchain.
+func (lib Library) Build(ctx core.Context) {
+	lib.CcLibrary(cc.DefaultToolchain()).Build(ctx)
+}
+
+type goSources Library
+
+// Go returns the generated Go sources, to be used in golang.Binary.Generated.
+// The .proto files must set the go_package option.
+func (lib Library) Go() goSources {
+	return goSources(lib)
+}
+
+// Build generates the Go sources of the library and its dependencies.
+func (srcs goSources) Build(ctx core.Context) {
+	lib := Library(srcs)
+	for _, dep := range lib.Deps {
+		goSources(dep).Build(ctx)
+	}
+	flags := []string{
+		fmt.Sprintf("--go_out=%q", core.BuildPath("")),
+		"--go_opt=paths=source_relative",
+	}
+	tools := []Tool{}
+	if lib.GoPlugin != nil {
+		tools = append(tools, lib.GoPlugin)
+		flags = append(flags, fmt.Sprintf("--plugin=protoc-gen-go=%q", lib.GoPlugin.Out()))
+	}
+	lib.generate(ctx, "Go", lib.outs("pb.go"), flags, tools)
+}
+
+// GoSources returns the generated Go sources of the library and its dependencies.
+func (srcs goSources) GoSources() []core.OutPath {
+	lib := Library(srcs)
+	outs := lib.outs("pb.go")
+	for _, dep := range lib.Deps {
+		outs = append(outs, goSources(dep).GoSources()...)
+	}
+	return outs
+}